@@ -0,0 +1,90 @@
+package gohm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The following states track whether the goroutine running the downstream
+// handler returned before gohm answered the request, or was abandoned by gohm
+// after a timeout or client disconnect, and kept running after the request was
+// answered.
+const (
+	handlerRunning int32 = iota
+	handlerReturned
+	handlerAbandoned
+)
+
+// abandonHandler is invoked after gohm answered the request without waiting
+// for the downstream handler to return, and records the handler as abandoned
+// when it is still running.  It must be invoked only after gohm no longer
+// accesses the responseWriter, because once abandoned, the handler's goroutine
+// will update it when the handler returns.
+func abandonHandler(counters *Counters, grw *responseWriter) {
+	// Increment the gauge before the handler could possibly decrement it.
+	if counters != nil {
+		atomic.AddUint64(&counters.abandoned, 1)
+	}
+	if !atomic.CompareAndSwapInt32(&grw.handlerState, handlerRunning, handlerAbandoned) {
+		// The handler returned after all.
+		if counters != nil {
+			atomic.AddUint64(&counters.abandoned, ^uint64(0))
+		}
+	}
+}
+
+// handlerFinished is invoked by the goroutine running the downstream handler
+// when the handler returns or panics, and returns true when gohm is still
+// waiting for the handler.  Otherwise the handler was abandoned, so it updates
+// counters and optionally logs how long the handler ran after its request was
+// answered, to LogWriter and Logger, and returns false.
+//
+// By the time an abandoned handler returns, the request has been answered, and
+// the server no longer permits the http.ResponseWriter to be used; the HTTP/2
+// server panics when it is.  Therefore the request is logged only from values
+// copied into the responseWriter, and the emitters are invoked without the
+// request.  The specified context is that of the request, for Logger.
+func handlerFinished(ctx context.Context, config *Config, emitters []func(*responseWriter, *http.Request, *[]byte), slogEmitters []func(*responseWriter, *http.Request, *[]byte) slog.Attr, grw *responseWriter, hp *handlerPanic) bool {
+	if atomic.CompareAndSwapInt32(&grw.handlerState, handlerRunning, handlerReturned) {
+		return true
+	}
+
+	overrun := time.Since(grw.end) // end is when gohm answered the request
+
+	if config.Counters != nil {
+		// Increment abandonedReturned last, so the other counters are updated
+		// once it is observed.
+		atomic.AddUint64(&config.Counters.abandonedOverrun, uint64(overrun))
+		atomic.AddUint64(&config.Counters.abandoned, ^uint64(0))
+		atomic.AddUint64(&config.Counters.abandonedReturned, 1)
+	}
+
+	if config.LogAbandoned && (config.LogWriter != nil || config.Logger != nil) {
+		grw.end = time.Now()
+		level := slog.LevelWarn
+		if hp != nil {
+			grw.responseError = fmt.Sprintf("abandoned handler panicked %s after response: %v", overrun, hp.value)
+			grw.panicValue = fmt.Sprintf("%v", hp.value)
+			grw.panicStack = hp.compact
+			level = slog.LevelError
+		} else {
+			grw.responseError = fmt.Sprintf("abandoned handler returned %s after response", overrun)
+		}
+		if config.LogWriter != nil {
+			buf := make([]byte, 0, 128)
+			for _, emitter := range emitters {
+				emitter(grw, nil, &buf)
+			}
+			_, _ = config.LogWriter.Write(buf)
+		}
+		if config.Logger != nil {
+			emitSlogRecord(ctx, config.Logger, slogEmitters, grw, nil, level)
+		}
+	}
+
+	return false
+}
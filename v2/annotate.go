@@ -0,0 +1,68 @@
+package gohm
+
+import "net/http"
+
+// SetMessage sets the message emitted by the {message} log directive for the
+// specified request, and given to Config.Callback in Statistics.Message.  It
+// works through the request context, so it may be called by any handler
+// downstream of gohm.New, even through middleware that wraps the
+// http.ResponseWriter, such as WithCompression.  It does nothing when the
+// request was not received through gohm.New, or gohm.New neither logs nor has
+// a Callback.
+//
+//	func someHandler(w http.ResponseWriter, r *http.Request) {
+//		gohm.SetMessage(r, "cache miss")
+//		// ...
+//	}
+func SetMessage(r *http.Request, message string) {
+	if rw, ok := r.Context().Value(responseWriterKey).(*responseWriter); ok {
+		rw.Message(message)
+	}
+}
+
+// Annotate sets the value of the specified field for the specified request.
+// The value is emitted by the {field-NAME} log directive, where NAME is the
+// specified key, and given to Config.Callback in Statistics.Fields.  Like
+// SetMessage, it works through the request context, and does nothing when the
+// request was not received through gohm.New, or gohm.New neither logs nor has
+// a Callback.
+//
+//	// Log format: "{client-ip} {status} user={field-user}"
+//	func someHandler(w http.ResponseWriter, r *http.Request) {
+//		gohm.Annotate(r, "user", username)
+//		// ...
+//	}
+func Annotate(r *http.Request, key, value string) {
+	if rw, ok := r.Context().Value(responseWriterKey).(*responseWriter); ok {
+		rw.fieldsLock.Lock()
+		if rw.fields == nil {
+			rw.fields = make(map[string]string)
+		}
+		rw.fields[key] = value
+		rw.fieldsLock.Unlock()
+	}
+}
+
+// field returns the value of the specified field annotated by the downstream
+// handler, and whether it was set.
+func (rw *responseWriter) field(key string) (string, bool) {
+	rw.fieldsLock.Lock()
+	defer rw.fieldsLock.Unlock()
+	value, ok := rw.fields[key]
+	return value, ok
+}
+
+// copyFields returns a copy of the fields annotated by the downstream handler,
+// or nil when there are none.
+func (rw *responseWriter) copyFields() map[string]string {
+	rw.fieldsLock.Lock()
+	defer rw.fieldsLock.Unlock()
+	if len(rw.fields) == 0 {
+		return nil
+	}
+	fields := make(map[string]string, len(rw.fields))
+	for k, v := range rw.fields {
+		fields[k] = v
+	}
+	return fields
+}
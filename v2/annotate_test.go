@@ -0,0 +1,102 @@
+package gohm_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestAnnotate(t *testing.T) {
+	t.Run("through wrapped response writer", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		var stats *gohm.Statistics
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+
+		handler := gohm.New(gohm.WithCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gohm.SetMessage(r, "cache miss")
+			gohm.Annotate(r, "user", "alice")
+			gohm.Annotate(r, "tenant", "acme")
+			w.Write([]byte("some body"))
+		})), gohm.Config{
+			Callback:  func(s *gohm.Statistics) { stats = s },
+			LogFormat: "{status} {message} user={field-user} tenant={field-tenant} missing={field-missing}",
+			LogWriter: logOutput,
+		})
+
+		handler.ServeHTTP(recorder, request)
+
+		if got, want := logOutput.String(), "200 cache miss user=alice tenant=acme missing=-\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+		if got, want := stats.Message, "cache miss"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := len(stats.Fields), 2; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.Fields["user"], "alice"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("without annotations", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), gohm.Config{
+			LogFormat: "{status} {message} {field-user}",
+			LogWriter: logOutput,
+		})
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+
+		if got, want := logOutput.String(), "200 - -\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("from timeout handler", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		release := make(chan struct{})
+		defer close(release)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}), gohm.Config{
+			LogFormat: "{status} {field-reason}",
+			LogWriter: logOutput,
+			Timeout:   5 * time.Millisecond,
+			TimeoutHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gohm.Annotate(r, "reason", "slow")
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}),
+		})
+
+		done := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("GOT: Annotate deadlocked; WANT: Annotate returned")
+		}
+		if got, want := logOutput.String(), "504 slow\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("outside gohm.New does nothing", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		gohm.SetMessage(request, "ignored")
+		gohm.Annotate(request, "user", "ignored")
+	})
+}
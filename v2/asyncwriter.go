@@ -0,0 +1,190 @@
+package gohm
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultAsyncWriterBufferSize is the number of log lines an AsyncWriter
+// buffers when AsyncWriterConfig.BufferSize is 0.
+const DefaultAsyncWriterBufferSize = 1024
+
+// errAsyncWriterClosed is returned when writing to a closed AsyncWriter.
+var errAsyncWriterClosed = errors.New("gohm: write to closed AsyncWriter")
+
+// AsyncWriterPolicy specifies what an AsyncWriter does with a log line written
+// when its buffer is full.
+type AsyncWriterPolicy int
+
+const (
+	// AsyncWriterDropNewest discards the log line being written, so requests
+	// are never delayed by logging.  This is the default.
+	AsyncWriterDropNewest AsyncWriterPolicy = iota
+
+	// AsyncWriterDropOldest discards the oldest buffered log line to make room
+	// for the log line being written, so requests are never delayed by
+	// logging, and the log holds the most recent requests.
+	AsyncWriterDropOldest
+
+	// AsyncWriterBlock waits for room in the buffer, so no log lines are lost,
+	// but requests are delayed when the underlying writer cannot keep up.
+	AsyncWriterBlock
+)
+
+// AsyncWriterConfig holds parameters for configuring an AsyncWriter.
+type AsyncWriterConfig struct {
+	// BufferSize is the maximum number of log lines buffered while waiting to
+	// be written.  When 0, DefaultAsyncWriterBufferSize is used.
+	BufferSize int
+
+	// Policy specifies what happens to a log line written when the buffer is
+	// full.  The zero value is AsyncWriterDropNewest.
+	Policy AsyncWriterPolicy
+}
+
+// AsyncWriter is an io.Writer that buffers log lines, and writes them to
+// another io.Writer from a background goroutine, so a slow disk or a blocked
+// pipe does not add latency to requests.  Each call to Write is treated as one
+// log line, which is never split or interleaved with another.  Log lines that
+// accumulate while the underlying writer is busy are written together with a
+// single call to its Write method.
+//
+//	logWriter := gohm.NewAsyncWriter(os.Stderr, gohm.AsyncWriterConfig{})
+//	defer logWriter.Close()
+//	h := gohm.New(someHandler, gohm.Config{LogWriter: logWriter})
+type AsyncWriter struct {
+	w      io.Writer
+	policy AsyncWriterPolicy
+
+	lock     sync.Mutex
+	notEmpty sync.Cond // notEmpty is signaled when a line is buffered, or when closed
+	notFull  sync.Cond // notFull is broadcast when lines are taken to be written, or when closed
+	lines    [][]byte  // lines is a ring buffer, whose slices are reused
+	head     int       // head is the index of the oldest buffered line
+	count    int       // count is the number of buffered lines
+	closed   bool
+	err      error // err is the first error returned by the underlying writer
+	done     chan struct{}
+
+	dropped uint64 // dropped must only be accessed atomically
+}
+
+// NewAsyncWriter returns an AsyncWriter that writes log lines to the specified
+// io.Writer.  Call its Close method to write buffered log lines and stop its
+// background goroutine.
+func NewAsyncWriter(w io.Writer, config AsyncWriterConfig) *AsyncWriter {
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultAsyncWriterBufferSize
+	}
+	aw := &AsyncWriter{
+		w:      w,
+		policy: config.Policy,
+		lines:  make([][]byte, config.BufferSize),
+		done:   make(chan struct{}),
+	}
+	aw.notEmpty.L = &aw.lock
+	aw.notFull.L = &aw.lock
+	go aw.flusher()
+	return aw
+}
+
+// Write buffers a copy of the specified log line to be written by the
+// background goroutine.  It returns an error after Close has been called.
+// When the buffer is full, the line is handled as directed by the
+// AsyncWriterPolicy, and lines that are dropped are counted, but do not cause
+// Write to return an error.
+func (aw *AsyncWriter) Write(p []byte) (int, error) {
+	aw.lock.Lock()
+	defer aw.lock.Unlock()
+
+	if aw.policy == AsyncWriterBlock {
+		for aw.count == len(aw.lines) && !aw.closed {
+			aw.notFull.Wait()
+		}
+	}
+	if aw.closed {
+		return 0, errAsyncWriterClosed
+	}
+	if aw.count == len(aw.lines) {
+		atomic.AddUint64(&aw.dropped, 1)
+		if aw.policy == AsyncWriterDropNewest {
+			return len(p), nil
+		}
+		// AsyncWriterDropOldest
+		aw.head = (aw.head + 1) % len(aw.lines)
+		aw.count--
+	}
+
+	tail := (aw.head + aw.count) % len(aw.lines)
+	aw.lines[tail] = append(aw.lines[tail][:0], p...)
+	aw.count++
+	aw.notEmpty.Signal()
+	return len(p), nil
+}
+
+// Close writes all buffered log lines to the underlying writer, stops the
+// background goroutine, and returns the first error the underlying writer
+// returned, if any.  It does not close the underlying writer.
+func (aw *AsyncWriter) Close() error {
+	aw.lock.Lock()
+	if !aw.closed {
+		aw.closed = true
+		aw.notEmpty.Signal()
+		aw.notFull.Broadcast()
+	}
+	aw.lock.Unlock()
+
+	<-aw.done
+
+	aw.lock.Lock()
+	defer aw.lock.Unlock()
+	return aw.err
+}
+
+// GetDropped returns the number of log lines dropped because the buffer was
+// full.
+func (aw *AsyncWriter) GetDropped() uint64 {
+	return atomic.LoadUint64(&aw.dropped)
+}
+
+// GetAndResetDropped returns the number of log lines dropped because the
+// buffer was full, and resets the counter to 0.
+func (aw *AsyncWriter) GetAndResetDropped() uint64 {
+	return atomic.SwapUint64(&aw.dropped, 0)
+}
+
+// flusher runs in the background goroutine, writing all buffered log lines as
+// a single batch each time the underlying writer is ready for more, until the
+// AsyncWriter is closed and its buffer is empty.
+func (aw *AsyncWriter) flusher() {
+	defer close(aw.done)
+	var batch []byte
+
+	for {
+		aw.lock.Lock()
+		for aw.count == 0 && !aw.closed {
+			aw.notEmpty.Wait()
+		}
+		if aw.count == 0 {
+			aw.lock.Unlock()
+			return // closed and buffer is empty
+		}
+		batch = batch[:0]
+		for ; aw.count > 0; aw.count-- {
+			batch = append(batch, aw.lines[aw.head]...)
+			aw.head = (aw.head + 1) % len(aw.lines)
+		}
+		aw.notFull.Broadcast()
+		aw.lock.Unlock()
+
+		if _, err := aw.w.Write(batch); err != nil {
+			aw.lock.Lock()
+			if aw.err == nil {
+				aw.err = err
+			}
+			aw.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package gohm_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+// gateWriter blocks each call to Write until its gate is opened, after
+// signaling that a write has started.
+type gateWriter struct {
+	started chan struct{}
+	gate    chan struct{}
+	lock    sync.Mutex
+	buf     bytes.Buffer
+	writes  int
+}
+
+func newGateWriter() *gateWriter {
+	return &gateWriter{started: make(chan struct{}, 100), gate: make(chan struct{})}
+}
+
+func (gw *gateWriter) Write(p []byte) (int, error) {
+	gw.started <- struct{}{}
+	<-gw.gate
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	gw.writes++
+	return gw.buf.Write(p)
+}
+
+func (gw *gateWriter) String() string {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	return gw.buf.String()
+}
+
+// fillAsyncWriter writes line 0, waits for the underlying writer to block
+// while writing it, then writes lines 1 through n.
+func fillAsyncWriter(t *testing.T, aw *gohm.AsyncWriter, gw *gateWriter, n int) {
+	t.Helper()
+	if _, err := aw.Write([]byte("0\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-gw.started
+	for i := 1; i <= n; i++ {
+		if _, err := aw.Write([]byte(strconv.Itoa(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAsyncWriterWritesAllLinesOnClose(t *testing.T) {
+	output := new(bytes.Buffer)
+	aw := gohm.NewAsyncWriter(output, gohm.AsyncWriterConfig{})
+
+	var want string
+	for i := 0; i < 100; i++ {
+		line := "line " + strconv.Itoa(i) + "\n"
+		want += line
+		if _, err := aw.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := output.String(); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := aw.GetDropped(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestAsyncWriterDropNewest(t *testing.T) {
+	gw := newGateWriter()
+	aw := gohm.NewAsyncWriter(gw, gohm.AsyncWriterConfig{BufferSize: 2})
+
+	fillAsyncWriter(t, aw, gw, 4)
+	close(gw.gate)
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := gw.String(), "0\n1\n2\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	// Lines buffered while the underlying writer was blocked are written
+	// together.
+	if got, want := gw.writes, 2; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := aw.GetAndResetDropped(), uint64(2); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := aw.GetDropped(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestAsyncWriterDropOldest(t *testing.T) {
+	gw := newGateWriter()
+	aw := gohm.NewAsyncWriter(gw, gohm.AsyncWriterConfig{BufferSize: 2, Policy: gohm.AsyncWriterDropOldest})
+
+	fillAsyncWriter(t, aw, gw, 4)
+	close(gw.gate)
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := gw.String(), "0\n3\n4\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := aw.GetDropped(), uint64(2); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestAsyncWriterBlock(t *testing.T) {
+	gw := newGateWriter()
+	aw := gohm.NewAsyncWriter(gw, gohm.AsyncWriterConfig{BufferSize: 2, Policy: gohm.AsyncWriterBlock})
+
+	fillAsyncWriter(t, aw, gw, 2)
+
+	written := make(chan struct{})
+	go func() {
+		_, _ = aw.Write([]byte("3\n"))
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("GOT: write returned; WANT: write blocked while buffer full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(gw.gate)
+	<-written
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := gw.String(), "0\n1\n2\n3\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := aw.GetDropped(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestAsyncWriterClose(t *testing.T) {
+	aw := gohm.NewAsyncWriter(failingWriter{}, gohm.AsyncWriterConfig{})
+
+	if _, err := aw.Write([]byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := aw.Close(), "disk full"; got == nil || got.Error() != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if _, err := aw.Write([]byte("line\n")); err == nil {
+		t.Errorf("GOT: %v; WANT: error", err)
+	}
+	// Closing again is harmless.
+	if got, want := aw.Close(), "disk full"; got == nil || got.Error() != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestAsyncWriterLogWriter(t *testing.T) {
+	output := new(bytes.Buffer)
+	aw := gohm.NewAsyncWriter(output, gohm.AsyncWriterConfig{Policy: gohm.AsyncWriterBlock})
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), gohm.Config{LogFormat: "{method} {uri} {status}", LogWriter: aw})
+
+	const requests = 50
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+		}()
+	}
+	wg.Wait()
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := output.String(), strings.Repeat("GET /some/url 200\n", requests); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
@@ -0,0 +1,36 @@
+package gohm
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// countingReadCloser counts the bytes read from the io.ReadCloser it wraps, and
+// records when reading stopped because the request body exceeded
+// Config.MaxRequestBytes.
+type countingReadCloser struct {
+	n        int64 // n is accessed atomically, because an abandoned handler may still be reading
+	tooLarge int32 // tooLarge is accessed atomically, and is set when the read limit was reached
+
+	io.ReadCloser
+}
+
+func (crc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := crc.ReadCloser.Read(p)
+	atomic.AddInt64(&crc.n, int64(n))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			atomic.StoreInt32(&crc.tooLarge, 1)
+		}
+	}
+	return n, err
+}
+
+// limitReached returns true when reading stopped because the request body
+// exceeded Config.MaxRequestBytes.
+func (crc *countingReadCloser) limitReached() bool {
+	return atomic.LoadInt32(&crc.tooLarge) == 1
+}
@@ -0,0 +1,184 @@
+package gohm
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shedError is the error message logged when a request is shed because the
+// concurrency limit has been reached.
+const shedError = "too many concurrent requests"
+
+const (
+	// adaptiveInitialLimit is the concurrency limit an adaptive limiter starts
+	// with, unless Config.MaxConcurrent is lower.
+	adaptiveInitialLimit = 10
+
+	// adaptiveBackoff is the factor by which an adaptive limiter multiplies its
+	// limit after it observes a timeout or rising latency.
+	adaptiveBackoff = 0.9
+
+	// adaptiveTolerance is how many times greater than the long term average
+	// latency the short term average latency may become before an adaptive
+	// limiter considers latency to be rising.
+	adaptiveTolerance = 2.0
+
+	// adaptiveShortWeight and adaptiveLongWeight are the weights given to each
+	// new latency sample by the short and long term exponentially weighted
+	// moving averages of latency.
+	adaptiveShortWeight = 0.1
+	adaptiveLongWeight  = 0.01
+)
+
+// limiter bounds the number of downstream handlers running at once.  A fixed
+// limiter always allows Config.MaxConcurrent handlers.  An adaptive limiter
+// adjusts its limit between 1 and Config.MaxConcurrent using additive increase,
+// multiplicative decrease: it adds one while latency stays flat and the limit
+// is being used, and cuts the limit when a handler times out, or when the
+// short term average latency rises well above the long term average.
+type limiter struct {
+	lock     sync.Mutex
+	waiters  []chan struct{} // waiters are closed in order as slots are released
+	inFlight int
+	limit    float64
+	maximum  float64
+	adaptive bool
+	counters *Counters // counters, when not nil, receives the current limit
+
+	shortLatency float64 // short term moving average of latency in nanoseconds
+	longLatency  float64 // long term moving average of latency in nanoseconds
+}
+
+func newLimiter(maximum int, adaptive bool, counters *Counters) *limiter {
+	l := &limiter{
+		limit:    float64(maximum),
+		maximum:  float64(maximum),
+		adaptive: adaptive,
+		counters: counters,
+	}
+	if adaptive && maximum > adaptiveInitialLimit {
+		l.limit = adaptiveInitialLimit
+	}
+	l.publish()
+	return l
+}
+
+// acquire attempts to obtain a slot, waiting up to the specified duration for
+// another request to release one, and returns true when successful.  It gives
+// up early when the specified done channel is closed, such as when the client
+// disconnects while waiting.
+func (l *limiter) acquire(wait time.Duration, done <-chan struct{}) bool {
+	l.lock.Lock()
+	if l.inFlight < int(l.limit) && len(l.waiters) == 0 {
+		l.inFlight++
+		l.lock.Unlock()
+		return true
+	}
+	if wait <= 0 {
+		l.lock.Unlock()
+		return false
+	}
+	granted := make(chan struct{})
+	l.waiters = append(l.waiters, granted)
+	l.lock.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-granted:
+		return true
+	case <-timer.C:
+	case <-done:
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, waiter := range l.waiters {
+		if waiter == granted {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// Slot was granted after giving up, but before the lock was obtained.
+	return true
+}
+
+// release returns a slot after a downstream handler returns, and, for an
+// adaptive limiter, adjusts the limit based on how long the handler ran and
+// whether it ran longer than its timeout.
+func (l *limiter) release(latency time.Duration, timedOut bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.adaptive {
+		l.adjust(latency, timedOut)
+	}
+	l.free()
+}
+
+// releaseUnmeasured returns a slot without adjusting the limit, because how long
+// the downstream handler ran says nothing about load, such as when it hijacked
+// the connection and served it for the life of a WebSocket or tunnel, or when
+// it never ran because the request body was too large.
+func (l *limiter) releaseUnmeasured() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.free()
+}
+
+// free returns a slot, and grants slots to waiters while the limit allows.  It
+// must be called with the lock held.
+func (l *limiter) free() {
+	l.inFlight--
+
+	for len(l.waiters) > 0 && l.inFlight < int(l.limit) {
+		l.inFlight++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// adjust updates the limit of an adaptive limiter after a handler returns.  It
+// must be called with the lock held, before the handler's slot is returned.
+func (l *limiter) adjust(latency time.Duration, timedOut bool) {
+	sample := float64(latency)
+	if l.longLatency == 0 {
+		l.shortLatency, l.longLatency = sample, sample
+	} else {
+		l.shortLatency += adaptiveShortWeight * (sample - l.shortLatency)
+		l.longLatency += adaptiveLongWeight * (sample - l.longLatency)
+	}
+
+	previous := int(l.limit)
+	if timedOut || l.shortLatency > adaptiveTolerance*l.longLatency {
+		l.limit = math.Max(1, l.limit*adaptiveBackoff)
+	} else if 2*l.inFlight >= previous {
+		// Only grow the limit when at least half of it is being used, so a
+		// lightly loaded server does not accumulate a limit it never tested.
+		l.limit = math.Min(l.maximum, l.limit+1)
+	}
+	if int(l.limit) != previous {
+		l.publish()
+	}
+}
+
+// publish stores the current limit in the counters gauge.
+func (l *limiter) publish() {
+	if l.counters != nil {
+		atomic.StoreUint64(&l.counters.concurrencyLimit, uint64(l.limit))
+	}
+}
+
+// retryAfterSeconds returns the value of the Retry-After header sent with a shed
+// request: the specified wait rounded up to whole seconds, but at least one.
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
@@ -0,0 +1,307 @@
+package gohm_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	t.Run("sheds when limit reached", func(t *testing.T) {
+		var counters gohm.Counters
+		var stats *gohm.Statistics
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			w.Write([]byte("ok"))
+		}), gohm.Config{
+			Callback:      func(s *gohm.Statistics) { stats = s },
+			Counters:      &counters,
+			MaxConcurrent: 1,
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/first", nil))
+		}()
+		<-started
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/second", nil))
+
+		resp := recorder.Result()
+		if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := resp.Header.Get("Retry-After"), "1"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetShed(), uint64(1); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.Shed, true; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		close(release)
+		<-done
+
+		// Slot released after first handler returned.
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/third", nil))
+
+		if got, want := recorder.Result().StatusCode, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.Shed, false; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetShed(), uint64(1); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("client disconnects while waiting", func(t *testing.T) {
+		var counters gohm.Counters
+		var stats *gohm.Statistics
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		}), gohm.Config{
+			Callback:          func(s *gohm.Statistics) { stats = s },
+			Counters:          &counters,
+			MaxConcurrent:     1,
+			MaxConcurrentWait: time.Second,
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/first", nil))
+		}()
+		<-started
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(5*time.Millisecond, cancel)
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/second", nil).WithContext(ctx))
+
+		if got, want := stats.ResponseStatus, gohm.StatusClientClosedRequest; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.ClientDisconnected, true; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.Shed, false; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetDisconnected(), uint64(1); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetShed(), uint64(0); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		close(release)
+		<-done
+	})
+
+	t.Run("waits for slot", func(t *testing.T) {
+		started := make(chan struct{})
+		var count int
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count++ // limit of 1 ensures no data race
+			if count == 1 {
+				close(started)
+				time.Sleep(5 * time.Millisecond)
+			}
+			w.Write([]byte("ok"))
+		}), gohm.Config{
+			MaxConcurrent:     1,
+			MaxConcurrentWait: time.Second,
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/first", nil))
+		}()
+		<-started
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/second", nil))
+		<-done
+
+		if got, want := recorder.Result().StatusCode, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("releases slot when request too large", func(t *testing.T) {
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}), gohm.Config{
+			MaxConcurrent:   1,
+			MaxRequestBytes: 4,
+		})
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/first", strings.NewReader("flubber")))
+
+		if got, want := recorder.Result().StatusCode, http.StatusRequestEntityTooLarge; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/second", nil))
+
+		if got, want := recorder.Result().StatusCode, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
+
+// loadTest sends the specified number of requests from each of the specified
+// number of concurrent clients, and returns the number of responses having each
+// status code.
+func loadTest(handler http.Handler, clients, requests int) map[int]int {
+	var lock sync.Mutex
+	statuses := make(map[int]int)
+	var wg sync.WaitGroup
+	wg.Add(clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/some/url", nil))
+				lock.Lock()
+				statuses[recorder.Code]++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	t.Run("grows while latency flat", func(t *testing.T) {
+		var counters gohm.Counters
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(2 * time.Millisecond)
+		}), gohm.Config{
+			AdaptiveConcurrency: true,
+			Counters:            &counters,
+			MaxConcurrent:       20,
+			MaxConcurrentWait:   time.Second,
+		})
+
+		if got, want := counters.GetConcurrencyLimit(), uint64(10); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		statuses := loadTest(handler, 20, 20)
+
+		if got, want := statuses[http.StatusOK], 400; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetConcurrencyLimit(), uint64(10); got <= want {
+			t.Errorf("GOT: %v; WANT: > %v", got, want)
+		}
+	})
+
+	t.Run("backs off under overload", func(t *testing.T) {
+		var counters gohm.Counters
+		var inFlight int64
+
+		// Simulate a downstream service whose latency grows with the number
+		// of requests it is serving at once.
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt64(&inFlight, 1)
+			defer atomic.AddInt64(&inFlight, -1)
+			time.Sleep(time.Duration(n) * time.Millisecond)
+		}), gohm.Config{
+			AdaptiveConcurrency: true,
+			Counters:            &counters,
+			MaxConcurrent:       50,
+			MaxConcurrentWait:   10 * time.Millisecond,
+			Timeout:             8 * time.Millisecond,
+		})
+
+		statuses := loadTest(handler, 40, 10)
+
+		// Limit oscillates around where latency reaches the timeout, well
+		// below the maximum.
+		if got, want := counters.GetConcurrencyLimit(), uint64(20); got >= want {
+			t.Errorf("GOT: %v; WANT: < %v", got, want)
+		}
+		if got := statuses[http.StatusOK]; got == 0 {
+			t.Errorf("GOT: %v; WANT: > 0", got)
+		}
+		if got, want := counters.GetShed(), uint64(0); got == want {
+			t.Errorf("GOT: %v; WANT: > %v", got, want)
+		}
+	})
+
+	t.Run("ignores hijacked connections", func(t *testing.T) {
+		var counters gohm.Counters
+		logged := make(chan struct{})
+
+		// The handler serves the hijacked connection for longer than the
+		// timeout, which must not be mistaken for overload.
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			time.Sleep(20 * time.Millisecond)
+		}), gohm.Config{
+			AdaptiveConcurrency: true,
+			Callback:            func(*gohm.Statistics) { close(logged) },
+			Counters:            &counters,
+			MaxConcurrent:       20,
+			Timeout:             5 * time.Millisecond,
+		})
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+		select {
+		case <-logged:
+		case <-time.After(time.Second):
+			t.Fatal("request not completed after connection closed")
+		}
+
+		if got, want := counters.GetConcurrencyLimit(), uint64(10); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
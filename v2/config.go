@@ -3,12 +3,29 @@ package gohm
 import (
 	"bytes"
 	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"time"
 )
 
 // Config specifies the parameters used for the wrapping the downstream
 // http.Handler.
 type Config struct {
+	// AdaptiveConcurrency, when set to true, causes the concurrency limit to
+	// adapt to the latency of the downstream handler rather than remain fixed
+	// at MaxConcurrent.  The limit starts at 10, or MaxConcurrent when lower,
+	// and varies between 1 and MaxConcurrent.  It increases by one as
+	// handlers complete while latency stays flat and at least half the limit
+	// is in use, and is cut by 10 percent when a handler runs past its timeout
+	// or when the recent average latency rises to more than twice the long
+	// term average.  Requests beyond the current limit wait up to
+	// MaxConcurrentWait, and are then shed.  The current limit is available
+	// from Counters.GetConcurrencyLimit.  This setting has no effect unless
+	// MaxConcurrent is set.  You cannot change this setting after creating the
+	// http.Handler.
+	AdaptiveConcurrency bool
+
 	// AllowPanics, when set to true, causes panics to propagate from downstream
 	// handlers.  When set to false, also the default value, panics will be
 	// converted into Internal Server Errors (status code 500).  You cannot
@@ -23,9 +40,23 @@ type Config struct {
 	// structure holding request and response information.
 	Callback func(*Statistics)
 
+	// CompiledLogFormat, when not nil, specifies the format for log lines,
+	// which was parsed and validated by CompileLogFormat, and takes precedence
+	// over LogFormat.  The handler uses the parsed format, rather than parsing
+	// it again.  You cannot change the log format after creating the
+	// http.Handler.
+	CompiledLogFormat *LogFormat
+
 	// Counters, if not nil, tracks counts of handler response status codes.
 	Counters *Counters
 
+	// DisconnectStatus specifies the status code used to log and count a
+	// request when the client closes the connection before the response is
+	// sent.  Nothing is sent to the client in this case.  When 0,
+	// StatusClientClosedRequest, 499, is used, so client disconnects are not
+	// counted as server errors.
+	DisconnectStatus int
+
 	// EscrowReader specifies whether the middleware handler ought to provide an
 	// escrow reader for the request body.  The escrow reader reads the body
 	// exactly once, storing the payload in a buffer, from which the downstream
@@ -35,6 +66,17 @@ type Config struct {
 	// the Statistics.ResponseBody.
 	EscrowReader bool
 
+	// LogAbandoned, when set to true and LogWriter or Logger is not nil, causes
+	// gohm to emit an additional log line for a request when its downstream
+	// handler finally returns after gohm already answered the request because
+	// of a timeout or client disconnect.  This helps find handlers that ignore
+	// context cancellation.  The log line is emitted regardless of LogBitmask,
+	// using LogFormat, where the {end} and {duration} directives reflect when
+	// the handler returned, and the {error} directive reports how long the
+	// handler ran after its request was answered.  Records emitted to Logger
+	// have level Warn, or Error when the handler panicked.
+	LogAbandoned bool
+
 	// LogBitmask, if not nil, specifies a bitmask to use to determine which
 	// HTTP status classes ought to be logged.  If not set, all HTTP requests
 	// will be logged.  This value may be changed using sync/atomic package even
@@ -51,43 +93,281 @@ type Config struct {
 	//	LogStatusErrors : LogStatusAll used to log HTTP requests which have 4xx or 5xx response
 	LogBitmask *uint32
 
+	// LogEscaping specifies how the values of string directives, such as uri,
+	// user-agent, and http-NAME, are escaped in text log lines, so clients
+	// cannot forge log lines by sending newlines, or send terminal control
+	// sequences to the people who read the log.  The zero value,
+	// LogEscapeApache, escapes values the way Apache Web Server does.  The
+	// escaping of an individual directive may be changed with a modifier, as
+	// described for LogFormat.  It does not apply to JSON log lines or records
+	// emitted to Logger, whose values are always properly escaped.  You cannot
+	// change this setting after creating the http.Handler.
+	LogEscaping LogEscaping
+
+	// LogFieldNames, when not nil, maps directive names to the names of the
+	// fields they populate when LogJSON is set, and of the attributes they
+	// populate in records emitted to Logger, for instance, mapping "client-ip"
+	// to "remote_addr".  Directives not in the map populate fields named after
+	// the directive.  You cannot change this setting after creating
+	// the http.Handler.
+	LogFieldNames map[string]string
+
 	// LogFormat specifies the format for log lines.  When left empty,
-	// gohm.DefaultLogFormat is used.  You cannot change the log format after
-	// creating the http.Handler.
+	// gohm.DefaultLogFormat is used.  The ApacheCommonLogFormat,
+	// ApacheCombinedLogFormat, LTSVLogFormat, and W3CExtendedLogFormat presets
+	// emit log lines in widely supported formats.  You cannot change the log
+	// format after creating the http.Handler.
 	//
 	// The following format directives are supported:
 	//
-	//	begin-epoch     : time request received (epoch)
-	//	begin-iso8601   : time request received (ISO-8601 time format)
-	//	begin           : time request received (apache log time format)
-	//	bytes           : response size
-	//	client-ip       : client IP address
-	//	client-port     : client port
-	//	client          : client-ip:client-port
-	//	duration        : duration of request from beginning to end, (seconds with millisecond precision)
-	//	end-epoch       : time request completed (epoch)
-	//	end-iso8601     : time request completed (ISO-8601 time format)
-	//	end             : time request completed (apache log time format)
-	//	error           : error message associated with attempting to serve the query
-	//	method          : request method, e.g., GET or POST
-	//	proto           : request protocol, e.g., HTTP/1.1
-	//	status          : response status code
-	//	status-text     : response status text
-	//	uri             : request URI
+	//	begin-epoch       : time request received (epoch)
+	//	begin-iso8601     : time request received (ISO-8601 time format)
+	//	begin             : time request received (apache log time format)
+	//	begin:LAYOUT      : time request received (UTC, formatted with Go time layout LAYOUT, e.g., {begin:2006-01-02})
+	//	bytes             : response size
+	//	client-ip         : client IP address
+	//	client-port       : client port
+	//	client            : client-ip:client-port
+	//	duration          : duration of request from beginning to end, (seconds with millisecond precision)
+	//	duration-ms       : duration of request in whole milliseconds
+	//	duration-ns       : duration of request in nanoseconds
+	//	duration-us       : duration of request in whole microseconds
+	//	end-epoch         : time request completed (epoch)
+	//	end-iso8601       : time request completed (ISO-8601 time format)
+	//	end               : time request completed (apache log time format)
+	//	end:LAYOUT        : time request completed (UTC, formatted with Go time layout LAYOUT)
+	//	error             : error message associated with attempting to serve the query
+	//	field-NAME        : value of field NAME set by gohm.Annotate
+	//	hijack-bytes-read : bytes read from a hijacked client connection, unlike request-bytes
+	//	host              : request host, e.g., example.com
+	//	message           : message set by gohm.SetMessage
+	//	method            : request method, e.g., GET or POST
+	//	panic             : value passed to panic by downstream handler
+	//	panic-stack       : compact stack trace of downstream handler panic
+	//	path              : request URL path
+	//	proto             : request protocol, e.g., HTTP/1.1
+	//	query             : request URL query string, without the question mark
+	//	referer           : value of Referer request header
+	//	remote-user       : user name from Basic authentication credentials, which are not verified
+	//	request-bytes     : bytes read from request body
+	//	request-id        : request ID, when RequestIDHeader is set
+	//	request-line      : request line, e.g., GET /some/url HTTP/1.1
+	//	resp-http-NAME    : value of response header NAME
+	//	sample-rate       : log sampling rate applied to request, e.g., 0.01
+	//	sampled           : true when request selected by LogBitmask and LogSampleRates
+	//	status            : response status code
+	//	status-text       : response status text
+	//	timeout           : effective timeout of request, (seconds with microsecond precision)
+	//	uri               : request URI
+	//	user-agent        : value of User-Agent request header
+	//
+	// Each directive may be followed by a vertical bar and one of the
+	// following modifiers, e.g., {uri|raw} or {http-User-Agent|quote}, to
+	// change how its value is escaped in text log lines:
+	//
+	//	apache          : escape value like LogEscapeApache
+	//	json            : escape value like LogEscapeJSON
+	//	quote           : escape value using LogEscaping, or like LogEscapeApache when LogEscapeNone, and enclose it in quotation marks
+	//	raw             : do not escape value
+	//	w3c             : escape value like LogEscapeApache, and replace spaces with plus signs
 	LogFormat string
 
+	// LogJSON, when set to true, causes each log line to be emitted as a JSON
+	// object rather than as text.  Each directive in LogFormat becomes a field
+	// of the object, and the constant text between directives is ignored.
+	// Numeric directives, such as status, bytes, and duration, are emitted as
+	// JSON numbers; begin and end are emitted as RFC 3339 strings, like their
+	// iso8601 variants; and all other values are emitted as properly escaped
+	// JSON strings.  Directives that have no value, which are emitted as "-"
+	// in text log lines, are emitted as null.  When several directives would
+	// become fields with the same name, only the first is emitted.  You cannot
+	// change this setting after creating the http.Handler.
+	LogJSON bool
+
+	// LogSampleRates, when not nil, specifies the fraction of requests in each
+	// status class that are logged, for instance, 1% of 2xx responses and all
+	// 5xx responses.  Sampling only applies to status classes selected by
+	// LogBitmask, and requests logged because they are slow or because the
+	// Callback invoked Statistics.Log are logged regardless of sampling.  The
+	// {sampled} directive emits whether a request was selected by sampling,
+	// and the {sample-rate} directive emits the rate that was applied, so log
+	// consumers may weight sampled requests.  The rates may be changed even
+	// after creating the http.Handler.
+	LogSampleRates *LogSampleRates
+
+	// LogSlowThreshold, when not 0, causes requests that take at least this
+	// long to be logged regardless of LogBitmask and LogSampleRates.  You
+	// cannot change this setting after creating the http.Handler.
+	LogSlowThreshold time.Duration
+
 	// LogWriter, if not nil, specifies that log lines ought to be written to
-	// the specified io.Writer.  You cannot change the io.Writer to which logs
-	// are written after creating the http.Handler.
+	// the specified io.Writer.  Each log line is written with one call to its
+	// Write method while the request is being served, so a slow io.Writer
+	// delays requests unless it is wrapped with NewAsyncWriter.  You cannot
+	// change the io.Writer to which logs are written after creating the
+	// http.Handler.
 	LogWriter io.Writer
 
+	// Logger, when not nil, specifies a log/slog Logger to which one record is
+	// emitted for each request, as an alternative or in addition to
+	// LogWriter.  LogBitmask and Statistics.Log decide whether a record is
+	// emitted, just as they do for log lines.  Each directive in LogFormat
+	// becomes an attribute of the record, named by LogFieldNames like the
+	// fields of JSON log lines, and the constant text between directives is
+	// ignored.  Times and durations become time.Time and time.Duration
+	// values, numeric directives become numbers, and directives that have no
+	// value are omitted.  Records for requests with 5xx status codes, or whose
+	// downstream handler panicked, have level Error; records for 4xx status
+	// codes have level Warn; and all others have level Info.  You cannot
+	// change this setting after creating the http.Handler.
+	Logger *slog.Logger
+
+	// MaxConcurrent, when not 0, specifies the maximum number of downstream
+	// handlers that may run at once.  A request that arrives when the limit has
+	// been reached waits up to MaxConcurrentWait for another handler to
+	// return.  When no slot becomes available in that time, the request is
+	// shed: the downstream handler is not invoked, and the client receives a
+	// 503 Service Unavailable response with a Retry-After header.  When the
+	// client disconnects while waiting, the downstream handler is not invoked
+	// either, and the request is counted and logged as a disconnect with
+	// DisconnectStatus rather than as shed.  The slot is taken before
+	// EscrowReader reads the request body, so a slow upload holds a slot while
+	// it is read.  A handler abandoned after a timeout continues to hold its
+	// slot until it returns, so the limit bounds the number of goroutines
+	// actually running downstream handlers.  When AdaptiveConcurrency is set,
+	// this is the upper bound of the adaptive limit.  You cannot change this
+	// setting after creating the http.Handler.
+	MaxConcurrent int
+
+	// MaxConcurrentWait specifies how long a request may wait for a slot when
+	// MaxConcurrent downstream handlers are already running.  When 0, requests
+	// that arrive while the limit has been reached are shed immediately.  This
+	// setting has no effect unless MaxConcurrent is set.  You cannot change
+	// this setting after creating the http.Handler.
+	MaxConcurrentWait time.Duration
+
+	// MaxRequestBytes, when not 0, specifies the maximum number of bytes that
+	// may be read from the request body, both by the escrow reader and by the
+	// downstream handler.  It also limits how much memory the escrow reader
+	// pre-allocates based on the client supplied Content-Length.  When a
+	// request body is known to exceed the limit, either from its
+	// Content-Length or because the escrow reader reached the limit, the
+	// downstream handler is not invoked, and the client receives a 413 Request
+	// Entity Too Large response.  Without EscrowReader, a chunked request
+	// body is only found to exceed the limit when the downstream handler reads
+	// past it, in which case its response is replaced with the same 413
+	// response, unless Streaming, when it may already have been sent.  Either
+	// way, Statistics.RequestBodyTruncated is set.  You cannot change this
+	// setting after creating the http.Handler.
+	MaxRequestBytes int64
+
+	// MaxResponseBytes, when not 0, specifies the maximum number of bytes the
+	// downstream handler may write in its response body.  Because gohm buffers
+	// the entire response in memory until the downstream handler returns, this
+	// protects the process from a handler that writes an unbounded response.
+	// Once the limit would be exceeded, Write returns ErrResponseTooLarge, and
+	// the client receives an error response with the MaxResponseBytesStatus
+	// status code rather than the truncated response.  This setting has no
+	// effect when Streaming.  You cannot change this setting after creating
+	// the http.Handler.
+	MaxResponseBytes int64
+
+	// MaxResponseBytesStatus specifies the status code sent to the client when
+	// the downstream handler attempts to write more than MaxResponseBytes.
+	// When 0, http.StatusInternalServerError is used, but a proxy may prefer
+	// http.StatusBadGateway.
+	MaxResponseBytesStatus int
+
+	// PanicHandler, when not nil, is invoked to write the response sent to the
+	// client when the downstream handler panics, with the recovered value, and
+	// the stack trace of the goroutine that panicked, as formatted by
+	// runtime/debug.Stack.  This allows services to log the stack trace, and
+	// to choose what the client sees rather than leak the panic value.  When
+	// nil, a 500 Internal Server Error response with the panic value is sent.
+	// It is not invoked when the response has already been committed while
+	// Streaming.  The {panic} and {panic-stack} log directives are available
+	// regardless of whether a PanicHandler is specified.
+	PanicHandler func(w http.ResponseWriter, r *http.Request, value interface{}, stack []byte)
+
+	// Redaction, when not nil, specifies request and response headers, query
+	// parameters, and patterns whose values are masked in log lines, and in
+	// the Statistics passed to Callback.  It applies to the uri, path, query,
+	// request-line, referer, user-agent, http-NAME, resp-http-NAME, message,
+	// and field-NAME directives, and to the RequestURL, ResponseHeader,
+	// Message, and Fields of Statistics, but not to the request and response
+	// bodies.  The remote-user directive still emits the user name from the
+	// Authorization header, which is not a secret, even when the header is
+	// redacted.  You cannot change this setting after creating the
+	// http.Handler.
+	Redaction *Redaction
+
+	// RequestIDHeader, when not empty, specifies the name of a header, such as
+	// "X-Request-ID", that holds an ID for each request.  When the client sends
+	// the header with a value no longer than 128 printable ASCII characters
+	// without spaces, that value is used; otherwise a random ID is generated
+	// and stored in the request header.  The ID is sent to the client in the
+	// same response header, stored in the request context where handlers may
+	// obtain it by calling gohm.RequestID, and emitted by the {request-id} log
+	// directive.  You cannot change this setting after creating the
+	// http.Handler.
+	RequestIDHeader string
+
+	// Streaming, when set to true, causes the response status, headers, and
+	// body written by the downstream handler to be sent to the client as they
+	// are written, rather than buffered until the downstream handler returns.
+	// In this mode the http.ResponseWriter given to the downstream handler
+	// implements http.Flusher, making it suitable for Server-Sent Events,
+	// long-polling, and large downloads.  When the handler times out or panics
+	// before it writes anything, the client receives the same error response
+	// as when not streaming.  When the handler times out or panics after its
+	// response has been committed, the error is logged and the client
+	// connection is aborted.  You cannot change this setting after creating
+	// the http.Handler.
+	Streaming bool
+
 	// `Timeout`, when not 0, specifies the amount of time allotted to wait for
 	// downstream `http.Handler` response.  You cannot change the handler
 	// timeout after creating the `http.Handler`.  The zero value for Timeout
 	// elides timeout protection, and `gohm` will wait forever for a downstream
 	// `http.Handler` to return.  It is recommended that a sensible timeout
 	// always be chosen for all production servers.
+	//
+	// When the downstream handler hijacks the client connection, for instance
+	// to upgrade it to the WebSocket protocol, gohm stops enforcing the
+	// timeout for that request, so the request context, which the handler may
+	// keep using for the life of the connection, is not canceled when the
+	// timeout elapses, and no longer reports the timeout's deadline.  gohm
+	// logs the request after the handler closes the connection.  Until then,
+	// the goroutine serving the request remains blocked, unless the request
+	// context is done, for instance because the context returned by
+	// http.Server.BaseContext is canceled.
 	Timeout time.Duration
+
+	// TimeoutHandler, when not nil, is invoked to write the response sent to
+	// the client when the downstream handler does not complete before the
+	// Timeout elapses, allowing services to customize the status code, the
+	// headers, and the body of the response, for instance to send a JSON
+	// error.  The request's context reports context.DeadlineExceeded from its
+	// Err method.  When nil, a 503 Service Unavailable response is sent.  It
+	// is not invoked when the client disconnects before the timeout, nor when
+	// the response has already been committed while Streaming.
+	TimeoutHandler http.Handler
+
+	// TimeoutHeader, when not empty, specifies the name of a request header,
+	// e.g., "X-Request-Timeout" or "grpc-timeout", from which a client may
+	// request a shorter timeout than Timeout, because it will give up waiting
+	// for the response sooner.  The syntax of the value depends on the name of
+	// the header.  When it is "grpc-timeout", the value must be in
+	// grpc-timeout format, e.g., "250m" for 250 milliseconds.  Otherwise the
+	// value may be a Go duration, e.g., "1.5s", or a decimal number of
+	// seconds, e.g., "2", so "2m" is 2 minutes rather than 2 milliseconds.
+	// The requested timeout is clamped to Timeout, so it can only shorten the
+	// timeout.  When Timeout is 0, the header is ignored, because nothing
+	// would bound the timeout a client could request.  Values that cannot be
+	// parsed are ignored.  Downstream handlers may use gohm.RemainingTime to
+	// read the remaining time budget from the request context, and the
+	// {timeout} log directive emits the effective timeout.
+	TimeoutHeader string
 }
 
 // BytesBufferPool specifies any structure that can provide bytes.Buffer
@@ -100,6 +380,10 @@ type BytesBufferPool interface {
 
 // Statistics structures are passed to callback functions after the downstream
 // handler has completed services the request.
+//
+// Byte slices and maps referenced by a Statistics structure may be reused after
+// the callback returns, so the callback must copy any of them it needs to
+// retain.
 type Statistics struct {
 	// RequestBegin is the time the request handling began.
 	RequestBegin time.Time
@@ -107,12 +391,71 @@ type Statistics struct {
 	// RequestBody is the byte slice of the request body, if applicable.
 	RequestBody []byte
 
+	// RequestBodyTruncated is true when the request body exceeded
+	// Config.MaxRequestBytes, in which case RequestBody holds only the bytes
+	// read before the limit was reached.
+	RequestBodyTruncated bool
+
+	// RequestID is the ID of the request, or the empty string when
+	// Config.RequestIDHeader is not set.
+	RequestID string
+
+	// RequestMethod is the method of the request, e.g., GET or POST.
+	RequestMethod string
+
+	// RequestURL is a copy of the request URL, made before the downstream
+	// handler was invoked, so it does not reflect any changes the handler made
+	// to the request's URL.
+	RequestURL *url.URL
+
 	// ResponseStatus is the status code of the response.
 	ResponseStatus int
 
+	// ResponseHeader holds the response headers sent to the client.
+	ResponseHeader http.Header
+
+	// ResponseBody is the byte slice of the response body the downstream
+	// handler wrote, or nil when Streaming.  When the handler timed out,
+	// panicked, or wrote more than Config.MaxResponseBytes, it holds what the
+	// handler wrote, rather than the error response sent to the client.
+	ResponseBody []byte
+
+	// ResponseBytes is the number of bytes of response body sent to the
+	// client.
+	ResponseBytes int64
+
 	// ResponseEnd is the time response writing completed.
 	ResponseEnd time.Time
 
+	// Error is the error message associated with attempting to serve the
+	// request, the same value emitted by the {error} log directive, or the
+	// empty string when there was no error.
+	Error string
+
+	// ClientDisconnected is true when the client closed the connection before
+	// the response was sent.
+	ClientDisconnected bool
+
+	// Panicked is true when the downstream handler panicked.
+	Panicked bool
+
+	// Shed is true when the request was rejected without invoking the
+	// downstream handler because Config.MaxConcurrent handlers were already
+	// running.
+	Shed bool
+
+	// TimedOut is true when the downstream handler did not complete before
+	// Config.Timeout elapsed.
+	TimedOut bool
+
+	// Fields holds the fields set by the downstream handler by calling
+	// gohm.Annotate, or nil when none were set.
+	Fields map[string]string
+
+	// Message is the message set by the downstream handler by calling
+	// gohm.SetMessage, or the empty string when none was set.
+	Message string
+
 	emitLog bool
 }
 
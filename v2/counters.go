@@ -1,9 +1,50 @@
 package gohm
 
 import (
+	"net/http"
 	"sync/atomic"
+	"time"
 )
 
+// Range of status codes counted individually by Counters.
+const (
+	minCountedStatus = 100
+	maxCountedStatus = 599
+)
+
+// countedMethods lists the request methods counted individually by Counters.
+// Requests with other methods are counted together.
+var countedMethods = [...]string{
+	http.MethodConnect,
+	http.MethodDelete,
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodPatch,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodTrace,
+}
+
+// methodIndexes maps each method in countedMethods to its index.
+var methodIndexes = func() map[string]int {
+	m := make(map[string]int, len(countedMethods))
+	for i, method := range countedMethods {
+		m[method] = i
+	}
+	return m
+}()
+
+// methodIndex returns the index of the counter for the specified request
+// method: its index in countedMethods, or len(countedMethods) for other
+// methods.
+func methodIndex(method string) int {
+	if i, ok := methodIndexes[method]; ok {
+		return i
+	}
+	return len(countedMethods)
+}
+
 // Counters structure store status counters used to track number of HTTP
 // responses resulted in various status classes.
 //
@@ -17,8 +58,45 @@ import (
 //	countOf4xx := counters.Get4xx()
 //	countOf5xx := counters.Get5xx()
 //	countTotal := counters.GetAll()
+//	countOf404 := counters.GetStatus(http.StatusNotFound)
+//	countOfGet := counters.GetMethod(http.MethodGet)
 type Counters struct {
-	counters [6]uint64
+	counters          [6]uint64
+	abandoned         uint64 // gauge of downstream handlers still running after their request was answered
+	abandonedOverrun  uint64 // nanoseconds abandoned handlers ran after their request was answered
+	abandonedReturned uint64 // abandoned handlers that have since returned
+	concurrencyLimit  uint64 // gauge of current Config.MaxConcurrent or adaptive concurrency limit
+	disconnected      uint64 // requests for which client disconnected before the response was sent
+	shed              uint64 // requests rejected because Config.MaxConcurrent handlers were running
+	tooLarge          uint64 // responses replaced with an error because they exceeded Config.MaxResponseBytes
+
+	// detail holds a *detailCounters, allocated when the first request is
+	// counted.  It is kept out of this structure so the status class getters,
+	// which have value receivers, need not copy it.
+	detail atomic.Value
+}
+
+// detailCounters store the per status code and per method counters.
+type detailCounters struct {
+	methods     [len(countedMethods) + 1]uint64                 // requests by method, with other methods last
+	statusCodes [maxCountedStatus - minCountedStatus + 1]uint64 // responses by status code, from 100 through 599
+}
+
+// details returns the per status code and per method counters, or nil when no
+// request has been counted yet.
+func (c *Counters) details() *detailCounters {
+	d, _ := c.detail.Load().(*detailCounters)
+	return d
+}
+
+// detailsForUpdate returns the per status code and per method counters,
+// allocating them when no request has been counted yet.
+func (c *Counters) detailsForUpdate() *detailCounters {
+	if d := c.details(); d != nil {
+		return d
+	}
+	c.detail.CompareAndSwap(nil, new(detailCounters))
+	return c.details()
 }
 
 // GetAll returns total number of HTTP responses, regardless of status code.
@@ -86,3 +164,243 @@ func (c *Counters) GetAndReset4xx() uint64 {
 func (c *Counters) GetAndReset5xx() uint64 {
 	return atomic.SwapUint64(&(c.counters[5]), 0)
 }
+
+// GetTooLarge returns number of HTTP responses that were replaced with an error
+// response because the downstream handler attempted to write more than
+// Config.MaxResponseBytes.
+func (c *Counters) GetTooLarge() uint64 {
+	return atomic.LoadUint64(&(c.tooLarge))
+}
+
+// GetAndResetTooLarge returns number of HTTP responses that were replaced with
+// an error response because the downstream handler attempted to write more
+// than Config.MaxResponseBytes, and resets the counter to 0.
+func (c *Counters) GetAndResetTooLarge() uint64 {
+	return atomic.SwapUint64(&(c.tooLarge), 0)
+}
+
+// GetDisconnected returns number of HTTP requests for which the client closed
+// the connection before the response was sent.  These requests are also
+// counted using Config.DisconnectStatus, which defaults to 499, a 4xx status
+// code.
+func (c *Counters) GetDisconnected() uint64 {
+	return atomic.LoadUint64(&(c.disconnected))
+}
+
+// GetAndResetDisconnected returns number of HTTP requests for which the client
+// closed the connection before the response was sent, and resets the counter
+// to 0.
+func (c *Counters) GetAndResetDisconnected() uint64 {
+	return atomic.SwapUint64(&(c.disconnected), 0)
+}
+
+// GetConcurrencyLimit returns the current concurrency limit: Config.MaxConcurrent
+// when the limit is fixed, or the limit most recently chosen when
+// Config.AdaptiveConcurrency is set.  It returns 0 when there is no concurrency
+// limit.  Like GetAbandoned, this is a gauge, and cannot be reset.  When the same
+// Counters are given to multiple handlers with concurrency limits, it returns
+// the limit most recently chosen by any of them.
+func (c *Counters) GetConcurrencyLimit() uint64 {
+	return atomic.LoadUint64(&(c.concurrencyLimit))
+}
+
+// GetShed returns number of HTTP requests rejected with a 503 response without
+// invoking the downstream handler, because Config.MaxConcurrent handlers were
+// already running.
+func (c *Counters) GetShed() uint64 {
+	return atomic.LoadUint64(&(c.shed))
+}
+
+// GetAndResetShed returns number of HTTP requests rejected with a 503 response
+// without invoking the downstream handler, because Config.MaxConcurrent
+// handlers were already running, and resets the counter to 0.
+func (c *Counters) GetAndResetShed() uint64 {
+	return atomic.SwapUint64(&(c.shed), 0)
+}
+
+// GetAbandoned returns number of downstream handlers still running after gohm
+// answered their request because of a timeout or client disconnect.  Unlike the
+// other counters, this is a gauge, and cannot be reset.
+func (c *Counters) GetAbandoned() uint64 {
+	return atomic.LoadUint64(&(c.abandoned))
+}
+
+// GetAbandonedReturned returns number of abandoned downstream handlers that
+// have since returned.
+func (c *Counters) GetAbandonedReturned() uint64 {
+	return atomic.LoadUint64(&(c.abandonedReturned))
+}
+
+// GetAndResetAbandonedReturned returns number of abandoned downstream handlers
+// that have since returned, and resets the counter to 0.
+func (c *Counters) GetAndResetAbandonedReturned() uint64 {
+	return atomic.SwapUint64(&(c.abandonedReturned), 0)
+}
+
+// GetAbandonedOverrun returns the total amount of time abandoned downstream
+// handlers that have since returned ran after gohm answered their request.
+// Dividing this by the value returned by GetAbandonedReturned provides the mean
+// time an abandoned handler ran past its deadline.
+func (c *Counters) GetAbandonedOverrun() time.Duration {
+	return time.Duration(atomic.LoadUint64(&(c.abandonedOverrun)))
+}
+
+// GetAndResetAbandonedOverrun returns the total amount of time abandoned
+// downstream handlers that have since returned ran after gohm answered their
+// request, and resets the counter to 0.
+func (c *Counters) GetAndResetAbandonedOverrun() time.Duration {
+	return time.Duration(atomic.SwapUint64(&(c.abandonedOverrun), 0))
+}
+
+// GetStatus returns number of HTTP responses resulting in the specified status
+// code.  Status codes from 100 through 599 are counted individually, and it
+// returns 0 for other status codes.
+func (c *Counters) GetStatus(status int) uint64 {
+	d := c.details()
+	if d == nil || status < minCountedStatus || status > maxCountedStatus {
+		return 0
+	}
+	return atomic.LoadUint64(&(d.statusCodes[status-minCountedStatus]))
+}
+
+// GetAndResetStatus returns number of HTTP responses resulting in the specified
+// status code, and resets the counter to 0.
+func (c *Counters) GetAndResetStatus(status int) uint64 {
+	d := c.details()
+	if d == nil || status < minCountedStatus || status > maxCountedStatus {
+		return 0
+	}
+	return atomic.SwapUint64(&(d.statusCodes[status-minCountedStatus]), 0)
+}
+
+// GetStatusCodes returns number of HTTP responses resulting in each status code
+// for which there has been at least one response.
+func (c *Counters) GetStatusCodes() map[int]uint64 {
+	counts := make(map[int]uint64)
+	d := c.details()
+	if d == nil {
+		return counts
+	}
+	for i := range d.statusCodes {
+		if count := atomic.LoadUint64(&(d.statusCodes[i])); count > 0 {
+			counts[i+minCountedStatus] = count
+		}
+	}
+	return counts
+}
+
+// GetAndResetStatusCodes returns number of HTTP responses resulting in each
+// status code for which there has been at least one response, and resets the
+// counters to 0.
+func (c *Counters) GetAndResetStatusCodes() map[int]uint64 {
+	counts := make(map[int]uint64)
+	d := c.details()
+	if d == nil {
+		return counts
+	}
+	for i := range d.statusCodes {
+		if count := atomic.SwapUint64(&(d.statusCodes[i]), 0); count > 0 {
+			counts[i+minCountedStatus] = count
+		}
+	}
+	return counts
+}
+
+// GetMethod returns number of HTTP requests with the specified method.  The
+// methods defined by net/http, such as GET and POST, are counted individually,
+// and it returns 0 for other methods, whose requests are counted together by
+// GetOtherMethods.
+func (c *Counters) GetMethod(method string) uint64 {
+	d := c.details()
+	i := methodIndex(method)
+	if d == nil || i == len(countedMethods) {
+		return 0
+	}
+	return atomic.LoadUint64(&(d.methods[i]))
+}
+
+// GetAndResetMethod returns number of HTTP requests with the specified method,
+// and resets the counter to 0.  Like GetMethod, it returns 0 for methods that
+// are not counted individually.
+func (c *Counters) GetAndResetMethod(method string) uint64 {
+	d := c.details()
+	i := methodIndex(method)
+	if d == nil || i == len(countedMethods) {
+		return 0
+	}
+	return atomic.SwapUint64(&(d.methods[i]), 0)
+}
+
+// GetOtherMethods returns number of HTTP requests with methods not defined by
+// net/http, which are not counted individually.
+func (c *Counters) GetOtherMethods() uint64 {
+	d := c.details()
+	if d == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&(d.methods[len(countedMethods)]))
+}
+
+// GetAndResetOtherMethods returns number of HTTP requests with methods not
+// defined by net/http, and resets the counter to 0.
+func (c *Counters) GetAndResetOtherMethods() uint64 {
+	d := c.details()
+	if d == nil {
+		return 0
+	}
+	return atomic.SwapUint64(&(d.methods[len(countedMethods)]), 0)
+}
+
+// GetMethods returns number of HTTP requests with each method for which there
+// has been at least one request.  Requests with methods not defined by
+// net/http are counted together under the empty string key, which holds the
+// count returned by GetOtherMethods.
+func (c *Counters) GetMethods() map[string]uint64 {
+	counts := make(map[string]uint64)
+	d := c.details()
+	if d == nil {
+		return counts
+	}
+	for i := range d.methods {
+		if count := atomic.LoadUint64(&(d.methods[i])); count > 0 {
+			counts[methodName(i)] = count
+		}
+	}
+	return counts
+}
+
+// GetAndResetMethods returns number of HTTP requests with each method for which
+// there has been at least one request, and resets the counters to 0.  Like
+// GetMethods, requests with other methods are counted under the empty string
+// key.
+func (c *Counters) GetAndResetMethods() map[string]uint64 {
+	counts := make(map[string]uint64)
+	d := c.details()
+	if d == nil {
+		return counts
+	}
+	for i := range d.methods {
+		if count := atomic.SwapUint64(&(d.methods[i]), 0); count > 0 {
+			counts[methodName(i)] = count
+		}
+	}
+	return counts
+}
+
+// methodName returns the method counted by the method counter with the
+// specified index, or the empty string for the counter of other methods.
+func methodName(i int) string {
+	if i < len(countedMethods) {
+		return countedMethods[i]
+	}
+	return ""
+}
+
+// count updates the per status code and per method counters for a request.
+func (c *Counters) count(status int, method string) {
+	d := c.detailsForUpdate()
+	if status >= minCountedStatus && status <= maxCountedStatus {
+		atomic.AddUint64(&(d.statusCodes[status-minCountedStatus]), 1)
+	}
+	atomic.AddUint64(&(d.methods[methodIndex(method)]), 1)
+}
@@ -1,9 +1,11 @@
 package gohm_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/karrick/gohm/v2"
@@ -208,6 +210,97 @@ func TestStatusCounters5xx(t *testing.T) {
 	}
 }
 
+func TestStatusCodeAndMethodCounters(t *testing.T) {
+	var counters gohm.Counters
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	}), gohm.Config{Counters: &counters})
+
+	requests := []struct {
+		method string
+		status int
+	}{
+		{"GET", http.StatusNotFound},
+		{"GET", http.StatusNotFound},
+		{"POST", http.StatusUnauthorized},
+		{"PROPFIND", http.StatusMultiStatus},
+		{"GET", http.StatusOK},
+	}
+	for _, request := range requests {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(request.method, "/some/url?status="+strconv.Itoa(request.status), nil))
+	}
+
+	// class counters are unaffected
+	if got, want := counters.Get4xx(), uint64(3); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	if got, want := counters.GetStatus(http.StatusNotFound), uint64(2); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetStatus(http.StatusForbidden), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetStatus(999), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetMethod("GET"), uint64(3); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetMethod("MKCOL"), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetMethod(""), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetOtherMethods(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	statusCodes := counters.GetStatusCodes()
+	if got, want := fmt.Sprint(statusCodes), "map[200:1 207:1 401:1 404:2]"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	methods := counters.GetMethods()
+	if got, want := fmt.Sprint(methods), "map[:1 GET:3 POST:1]"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	// get and reset counters
+	if got, want := counters.GetAndResetStatus(http.StatusNotFound), uint64(2); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetStatus(http.StatusNotFound), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetAndResetMethod("POST"), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetMethod("POST"), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetAndResetMethod("MKCOL"), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetAndResetOtherMethods(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetOtherMethods(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := fmt.Sprint(counters.GetAndResetStatusCodes()), "map[200:1 207:1 401:1]"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := fmt.Sprint(counters.GetAndResetMethods()), "map[GET:3]"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := len(counters.GetStatusCodes())+len(counters.GetMethods()), 0; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
 func BenchmarkWithCounters(b *testing.B) {
 	var counters gohm.Counters
 
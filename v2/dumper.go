@@ -12,9 +12,18 @@ import (
 // flag. When 0, requests will not be dumped. When 1, all but the body will be
 // dumped. When 2, the entire request including the body will be dumped.
 func WithRequestDumper(flag *uint32, next http.Handler) http.Handler {
+	return WithRedactedRequestDumper(flag, nil, next)
+}
+
+// WithRedactedRequestDumper is like WithRequestDumper, but when the specified
+// redaction is not nil, the dumped request has the values of its redacted
+// headers and query parameters masked, and the matches of the redaction's
+// patterns masked throughout, including in the body.  The request passed to
+// the downstream handler is not modified.
+func WithRedactedRequestDumper(flag *uint32, redaction *Redaction, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if value := atomic.LoadUint32(flag); value > 0 {
-			buf, err := httputil.DumpRequest(r, value == 2)
+			buf, err := dumpRequest(r, value == 2, redaction)
 			if err != nil {
 				log.Printf("cannot dump request: %s", err)
 			}
@@ -23,3 +32,29 @@ func WithRequestDumper(flag *uint32, next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// dumpRequest returns the dump of the specified request, redacted by the
+// specified redaction when it is not nil.
+func dumpRequest(r *http.Request, body bool, redaction *Redaction) ([]byte, error) {
+	if redaction == nil {
+		return httputil.DumpRequest(r, body)
+	}
+
+	// Dump a copy of the request, so redacting its headers and URL does not
+	// modify the request passed to the downstream handler.
+	dr := r.Clone(r.Context())
+	dr.Header = redaction.redactHeaders(r.Header)
+	dr.RequestURI = redaction.redactURI(r.RequestURI)
+	redaction.redactURL(dr.URL)
+
+	buf, err := httputil.DumpRequest(dr, body)
+	if body {
+		// DumpRequest replaced the body of the copy with one that reads the
+		// bytes it consumed from the original body.
+		r.Body = dr.Body
+	}
+	if err != nil {
+		return buf, err
+	}
+	return redaction.redactBody(buf), nil
+}
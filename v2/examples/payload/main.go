@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/karrick/gobp"
@@ -20,6 +21,9 @@ func main() {
 
 	bp := new(gobp.Pool) // See https://github.com/karrick/gobp for heavy use examples.
 
+	// Log errors, and requests slower than latencyThreshold.
+	logBitmask := gohm.LogStatusErrors
+
 	h := gohm.New(http.HandlerFunc(someHandler), gohm.Config{
 		BufPool: bp,
 		Callback: func(stats *gohm.Statistics) {
@@ -30,11 +34,11 @@ func main() {
 					log.Printf("non-empty request body: %s\n", string(stats.RequestBody))
 				}
 			}
-			if stats.ResponseEnd.Sub(stats.RequestBegin).Nanoseconds() > int64(latencyThreshold) {
-				stats.Log()
-			}
 		},
-		EscrowReader: true,
+		EscrowReader:     true,
+		LogBitmask:       &logBitmask,
+		LogSlowThreshold: latencyThreshold,
+		LogWriter:        os.Stderr,
 	})
 
 	log.Print("[INFO] web service port: ", *optPort)
@@ -5,4 +5,4 @@ require (
 	github.com/karrick/gorill v1.10.2
 )
 
-go 1.13
+go 1.21
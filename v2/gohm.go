@@ -3,15 +3,22 @@ package gohm
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/karrick/gorill"
 )
 
+// StatusClientClosedRequest is the non-standard status code, popularized by
+// nginx, used by default to log requests for which the client closed the
+// connection before the response was sent.
+const StatusClientClosedRequest = 499
+
 // New returns a new http.Handler that calls the specified next http.Handler,
 // and performs the requested operations before and after the downstream handler
 // as specified by the gohm.Config structure passed to it.
@@ -19,7 +26,7 @@ import (
 // It receives a gohm.Config struct rather than a pointer to one, so users less
 // likely to consider modification after creating the http.Handler.
 //
-//  // Used to control how long it takes to serve a static file.
+//	// Used to control how long it takes to serve a static file.
 //	const staticTimeout = time.Second
 //
 //	var (
@@ -28,7 +35,7 @@ import (
 //		counters gohm.Counters
 //
 //		// Used to dynamically control log level of HTTP logging. After handler
-//      // created, this must be accessed using the sync/atomic package.
+//		// created, this must be accessed using the sync/atomic package.
 //		logBitmask = gohm.LogStatusErrors
 //
 //		// Determines HTTP log format
@@ -55,25 +62,84 @@ import (
 //	}
 func New(next http.Handler, config Config) http.Handler {
 	var emitters []func(*responseWriter, *http.Request, *[]byte)
-	var loggedHeaders []string
+	var slogEmitters []func(*responseWriter, *http.Request, *[]byte) slog.Attr
+	var loggedHeaders, loggedResponseHeaders []string
 
-	if config.LogWriter != nil {
+	if config.LogWriter != nil || config.Logger != nil {
 		if config.LogBitmask == nil {
 			// Set a default bitmask to log all requests
 			logBitmask := LogStatusAll
 			config.LogBitmask = &logBitmask
 		}
+		var segments []logSegment
+		if config.CompiledLogFormat != nil {
+			// Use the format already parsed by CompileLogFormat.
+			config.LogFormat = config.CompiledLogFormat.String()
+			segments = config.CompiledLogFormat.segments
+		}
 		if config.LogFormat == "" {
 			// Set a default log line format
 			config.LogFormat = DefaultLogFormat
+			segments = nil
+		}
+		if segments == nil {
+			segments, _ = parseLogFormat(config.LogFormat, false)
+		}
+		loggedResponseHeaders = responseHeaderNames(segments)
+		if config.Logger != nil {
+			slogEmitters, loggedHeaders = compileSlogFormat(segments, config.LogFieldNames)
+		}
+		if config.LogWriter != nil {
+			if config.LogJSON {
+				emitters, loggedHeaders = compileJSONFormat(segments, config.LogFieldNames)
+			} else {
+				emitters, loggedHeaders = compileFormat(segments, config.LogEscaping)
+			}
 		}
-		emitters, loggedHeaders = compileFormat(config.LogFormat)
 	}
 	lrh := len(loggedHeaders)
 
+	if config.DisconnectStatus == 0 {
+		config.DisconnectStatus = StatusClientClosedRequest
+	}
+
+	var requestTooLargeText string
+	if config.MaxRequestBytes > 0 {
+		requestTooLargeText = "request body exceeds " + strconv.FormatInt(config.MaxRequestBytes, 10) + " bytes"
+	}
+
+	// The grpc-timeout header has its own syntax, which is not mixed with the
+	// syntax of other timeout headers.
+	grpcTimeoutHeader := strings.EqualFold(config.TimeoutHeader, "grpc-timeout")
+
+	var concurrency *limiter
+	var retryAfter string
+	if config.MaxConcurrent > 0 {
+		concurrency = newLimiter(config.MaxConcurrent, config.AdaptiveConcurrency, config.Counters)
+		retryAfter = retryAfterSeconds(config.MaxConcurrentWait)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var er *gorill.EscrowReader
 		var requestHeaders map[string]string
+		var requestTooLarge, shed bool
+		var waitAborted error // waitAborted is the error of the request context when the client disconnected while waiting for a slot
+
+		var requestID string
+		if config.RequestIDHeader != "" {
+			// Accept the client's request ID when it is safe to echo and log,
+			// or generate one.  The ID is stored in the request header so
+			// handlers that forward request headers propagate it, and so it
+			// is logged by the {http-NAME} directive for the same header.
+			// Therefore this must precede copying the logged headers.
+			requestID = r.Header.Get(config.RequestIDHeader)
+			if !validRequestID(requestID) {
+				requestID = newRequestID()
+				r.Header.Set(config.RequestIDHeader, requestID)
+			}
+			w.Header().Set(config.RequestIDHeader, requestID)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey, requestID))
+		}
 
 		if lrh > 0 {
 			// When any request headers are to be logged, this must copy the
@@ -84,15 +150,45 @@ func New(next http.Handler, config Config) http.Handler {
 			// them to emit the log line.
 			requestHeaders = make(map[string]string, lrh)
 			for _, name := range loggedHeaders {
-				value := r.Header.Get(name)
-				if value == "" {
-					value = "-"
+				requestHeaders[name] = r.Header.Get(name) // NOTE: only saves first value, because that is all that is logged.
+			}
+		}
+
+		if concurrency != nil {
+			// Wait a bounded amount of time for a slot, and shed the request
+			// when none become available.  The slot is released when the
+			// goroutine running the downstream handler returns, even when it
+			// returns after the request was answered.  When the wait is cut
+			// short because the request context is done, there is nobody to
+			// respond to, so the request is reported as a disconnect rather
+			// than shed.
+			if !concurrency.acquire(config.MaxConcurrentWait, r.Context().Done()) {
+				if waitAborted = r.Context().Err(); waitAborted == nil {
+					shed = true
 				}
-				requestHeaders[name] = value // NOTE: only saves first value, because that is all that is logged.
 			}
 		}
 
-		if config.EscrowReader {
+		if config.MaxRequestBytes > 0 {
+			// Prevent both the escrow reader and the downstream handler from
+			// reading more than the maximum number of bytes from the request
+			// body, regardless of whether the client sent a Content-Length.
+			// When the client claims a larger Content-Length, the request will
+			// be rejected regardless of what the body holds.
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBytes)
+			requestTooLarge = r.ContentLength > config.MaxRequestBytes
+		}
+
+		var requestBody *countingReadCloser
+		if (config.LogWriter != nil || config.Logger != nil || config.MaxRequestBytes > 0) && r.Body != nil && r.Body != http.NoBody {
+			// Count bytes read from the request body, by either the escrow
+			// reader or the downstream handler, for the {request-bytes}
+			// directive, and detect when reading stopped at MaxRequestBytes.
+			requestBody = &countingReadCloser{ReadCloser: r.Body}
+			r.Body = requestBody
+		}
+
+		if config.EscrowReader && !shed && waitAborted == nil {
 			var erb *bytes.Buffer // escrow read buffer
 			if config.BufPool != nil {
 				// Obtain a bytes.Buffer from the buffer pool, but use defer to
@@ -109,6 +205,11 @@ func New(next http.Handler, config Config) http.Handler {
 			// it cares, it will also check the same thing.
 			if contentLengthString := r.Header.Get("Content-Length"); contentLengthString != "" {
 				if contentLength, err := strconv.Atoi(contentLengthString); err == nil {
+					if config.MaxRequestBytes > 0 && int64(contentLength) > config.MaxRequestBytes {
+						// Never trust the client to specify how much memory
+						// to allocate.
+						contentLength = int(config.MaxRequestBytes)
+					}
 					if erb != nil {
 						// Ensure existing buffer is large enough to read
 						// Content-Length bytes.
@@ -127,28 +228,66 @@ func New(next http.Handler, config Config) http.Handler {
 			// required.
 			er = gorill.NewEscrowReader(r.Body, erb)
 			r.Body = er
+
+			if requestBody != nil && requestBody.limitReached() {
+				// Reading stopped at the limit because the body, perhaps
+				// chunked with no Content-Length, holds more bytes.
+				requestTooLarge = true
+			}
+		}
+
+		tooLargeText := requestTooLargeText // sent when handler reads past MaxRequestBytes
+		if requestTooLarge {
+			tooLargeText = "" // rejected below, so need not reject again
+		}
+
+		// When the callback is to be invoked, this must copy the request URL
+		// before it creates a go routine to handle request, for the same
+		// reason request headers are copied above.
+		var requestURL *url.URL
+		if config.Callback != nil {
+			u := *r.URL
+			requestURL = &u
 		}
 
 		ctx := r.Context()
+		requestDone := ctx.Done() // done without regard to gohm's timeout
 
-		if config.Timeout > 0 {
-			// Adding a timeout to a request context spins off a goroutine that
-			// will invoke the specified cancel function for us after the
-			// timeout has elapsed.  Invoking the cancel function causes the
-			// context's Done channel to close.  Detecting timeout is done by
-			// waiting for context.Done() to close.
-			var cancel func()
-			ctx, cancel = context.WithTimeout(ctx, config.Timeout)
-			defer cancel()
+		timeout := config.Timeout
+		if config.TimeoutHeader != "" && timeout > 0 {
+			// Honor the client's request for a shorter timeout, but never a
+			// longer one.  Without a Timeout, there is no bound on the
+			// timeout a client could request, so the header is ignored.
+			if d, ok := parseTimeout(r.Header.Get(config.TimeoutHeader), grpcTimeoutHeader); ok && d < timeout {
+				timeout = d
+			}
+		}
+
+		var tctx *timeoutContext
+		if timeout > 0 {
+			// Adding a timeout to a request context starts a timer that will
+			// cancel the context for us after the timeout has elapsed, which
+			// causes the context's Done channel to close.  Detecting timeout is
+			// done by waiting for context.Done() to close.  When the request
+			// context already has an earlier deadline, that deadline is kept.
+			// The timer is stopped when the downstream handler hijacks the
+			// connection, so the hijacked connection may outlive the timeout.
+			tctx = newTimeoutContext(ctx, timeout)
+			defer tctx.release()
+			ctx = tctx
 			r = r.WithContext(ctx)
 		}
 
+		// When streaming, the response is written through to the client, so
+		// no response buffer is required.
 		var bb *bytes.Buffer
-		if config.BufPool != nil {
-			bb = config.BufPool.Get()
-			defer config.BufPool.Put(bb)
-		} else {
-			bb = new(bytes.Buffer)
+		if !config.Streaming {
+			if config.BufPool != nil {
+				bb = config.BufPool.Get()
+				defer config.BufPool.Put(bb)
+			} else {
+				bb = new(bytes.Buffer)
+			}
 		}
 
 		// Create a responseWriter to pass to next.ServeHTTP and collect
@@ -156,49 +295,146 @@ func New(next http.Handler, config Config) http.Handler {
 		// to flush to the client, assuming neither the handler panics, nor the
 		// client connection is detected to be closed.
 		grw := &responseWriter{
-			begin:          time.Now(),
-			responseBody:   bb,
-			responseWriter: w,
-			requestHeaders: requestHeaders,
-		}
-
-		// Create a couple of channels to detect one of 3 ways to exit this
-		// handler.
-		handlerCompleted := make(chan struct{})
-		handlerPanicked := make(chan interface{}, 1)
-
-		// We must invoke downstream handler in separate goroutine in order to
-		// ensure this handler only responds to one of the three events below,
-		// whichever event takes place first.
-		go func() {
-			defer func() {
-				if p := recover(); p != nil {
-					handlerPanicked <- p
-				}
+			begin:                 time.Now(),
+			loggedResponseHeaders: loggedResponseHeaders,
+			responseBody:          bb,
+			responseWriter:        w,
+			requestBody:           requestBody,
+			requestTooLarge:       tooLargeText,
+			requestHeaders:        requestHeaders,
+			requestHost:           r.Host,
+			requestMethod:         r.Method,
+			requestPath:           r.URL.Path,
+			requestProto:          r.Proto,
+			requestQuery:          r.URL.RawQuery,
+			requestRemoteAddr:     r.RemoteAddr,
+			requestDone:           requestDone,
+			requestID:             requestID,
+			requestURI:            r.RequestURI,
+			redaction:             config.Redaction,
+			streaming:             config.Streaming,
+			timeout:               timeout,
+			timeoutContext:        tctx,
+		}
+		if config.LogWriter != nil || config.Logger != nil || config.Callback != nil {
+			// Allow downstream handlers to annotate the log line and
+			// statistics by calling SetMessage and Annotate.
+			r = r.WithContext(context.WithValue(r.Context(), responseWriterKey, grw))
+		}
+		if config.MaxResponseBytes > 0 {
+			grw.maxResponseBytes = config.MaxResponseBytes
+			grw.tooLargeStatus = config.MaxResponseBytesStatus
+			if grw.tooLargeStatus == 0 {
+				grw.tooLargeStatus = http.StatusInternalServerError
+			}
+		}
+
+		var hp *handlerPanic
+		if shed {
+			// Respond without starting a goroutine for the downstream handler,
+			// which is the cost the concurrency limit bounds.
+			grw.handlerRespond(shedError, func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", retryAfter)
+				Error(w, shedError, http.StatusServiceUnavailable)
+			})
+		} else if waitAborted != nil {
+			// Like a disconnect while the handler runs, nothing is sent.
+			grw.disconnected = true
+			grw.end = time.Now()
+			grw.responseError = waitAborted.Error()
+			grw.writeHeader(config.DisconnectStatus)
+		} else if requestTooLarge {
+			// Respond with an error rather than invoke the downstream handler,
+			// but still account for the request like any other, including its
+			// error.  The handler will not run, so its slot is released now.
+			grw.handlerRespond(requestTooLargeText, func(w http.ResponseWriter) {
+				Error(w, requestTooLargeText, http.StatusRequestEntityTooLarge)
+			})
+			if concurrency != nil {
+				concurrency.releaseUnmeasured()
+			}
+		} else {
+			// Create a couple of channels to detect one of 3 ways to exit this
+			// handler.
+			handlerCompleted := make(chan struct{})
+			handlerPanicked := make(chan *handlerPanic, 1)
+
+			// The request context is saved for logging an abandoned handler,
+			// which must not use the request after the handler returned.
+			requestContext := r.Context()
+
+			// We must invoke downstream handler in separate goroutine in order to
+			// ensure this handler only responds to one of the three events below,
+			// whichever event takes place first.
+			go func() {
+				defer func() {
+					// hp is local to this goroutine, because after a timeout
+					// this handler is abandoned, and may panic while the
+					// request is being logged.
+					var hp *handlerPanic
+					if p := recover(); p != nil {
+						hp = recoverHandlerPanic(p)
+					}
+					if concurrency != nil {
+						// Release slot for another request.  A handler that
+						// ran past its timeout is a sign of overload, unless
+						// it hijacked the connection, in which case it ran for
+						// the life of the connection, which gohm does not
+						// time out.
+						if grw.hijacked != nil {
+							concurrency.releaseUnmeasured()
+						} else {
+							latency := time.Since(grw.begin)
+							concurrency.release(latency, grw.timeout > 0 && latency >= grw.timeout)
+						}
+					}
+					if !handlerFinished(requestContext, &config, emitters, slogEmitters, grw, hp) {
+						return // nobody is waiting for this abandoned handler
+					}
+					if hp != nil {
+						handlerPanicked <- hp
+					} else {
+						close(handlerCompleted)
+					}
+				}()
+				next.ServeHTTP(grw.handlerWriter(), r)
 			}()
-			next.ServeHTTP(grw, r)
-			// Will not get here when above line panics.
-			close(handlerCompleted)
-		}()
-
-		// Wait for the first of either of 3 events:
-		//   * handlerComplete: the next.ServeHTTP method completed normally
-		//     (possibly even with an erroneous status code).
-		//   * handlerPanicked: the next.ServeHTTP method failed to complete, and
-		//     panicked instead with a text message.
-		//   * context is done: triggered when timeout or client disconnect.
-		var p interface{}
-		select {
-		case <-handlerCompleted:
-			grw.handlerComplete()
-		case p = <-handlerPanicked:
-			grw.handlerError(fmt.Sprintf("%v", p), http.StatusInternalServerError)
-		case <-ctx.Done():
-			// When the context is canceled, ctx.Err() will say why.  Returning
-			// a 503 because this is what http.TimeoutHandler returns for same
-			// case, even though this means 503 will be logged in server log
-			// even when client has terminated the connection.
-			grw.handlerTimeout(ctx.Err().Error(), http.StatusServiceUnavailable)
+
+			// Wait for the first of either of 3 events:
+			//   * handlerComplete: the next.ServeHTTP method completed normally
+			//     (possibly even with an erroneous status code).
+			//   * handlerPanicked: the next.ServeHTTP method failed to complete, and
+			//     panicked instead with a text message.
+			//   * context is done: triggered when timeout or client disconnect.
+			select {
+			case <-handlerCompleted:
+				grw.handlerComplete()
+			case hp = <-handlerPanicked:
+				grw.handlerPanicked(r, hp, config.PanicHandler)
+			case <-ctx.Done():
+				// When the context is canceled, ctx.Err() will say why:
+				// context.DeadlineExceeded after the timeout, or context.Canceled
+				// after the client has terminated the connection.
+				if grw.handlerTimeout(r, ctx.Err(), config.DisconnectStatus, config.TimeoutHandler) {
+					break
+				}
+				// Downstream handler hijacked the connection before the context
+				// was done, and is now responsible for it, so stop enforcing the
+				// timeout and wait for the handler to finish.
+				select {
+				case <-handlerCompleted:
+					grw.handlerComplete()
+				case hp = <-handlerPanicked:
+					grw.handlerPanicked(r, hp, config.PanicHandler)
+				}
+			}
+		}
+
+		if grw.requestBody != nil && grw.requestBody.limitReached() {
+			// Without EscrowReader, the downstream handler discovered the
+			// request body exceeded the limit, perhaps because it was chunked
+			// with no Content-Length.
+			requestTooLarge = true
 		}
 
 		statusClass := grw.responseStatus / 100 // integer division (429 / 100 -> 4)
@@ -207,38 +443,105 @@ func New(next http.Handler, config Config) http.Handler {
 		if config.Counters != nil {
 			atomic.AddUint64(&config.Counters.counters[0], 1)           // all
 			atomic.AddUint64(&config.Counters.counters[statusClass], 1) // 1xx, 2xx, 3xx, 4xx, 5xx
+			config.Counters.count(grw.responseStatus, grw.requestMethod)
+			if grw.tooLargeSent {
+				atomic.AddUint64(&config.Counters.tooLarge, 1)
+			}
+			if grw.disconnected {
+				atomic.AddUint64(&config.Counters.disconnected, 1)
+			}
+			if shed {
+				atomic.AddUint64(&config.Counters.shed, 1)
+			}
 		}
 
 		// Invoke callback if provided, prior to logging request.
 		var stats *Statistics
 		if config.Callback != nil {
 			stats = &Statistics{
-				RequestBegin:   grw.begin,
-				ResponseStatus: grw.responseStatus,
-				ResponseEnd:    grw.end,
+				RequestBegin:         grw.begin,
+				RequestBodyTruncated: requestTooLarge,
+				RequestMethod:        grw.requestMethod,
+				RequestID:            requestID,
+				RequestURL:           requestURL,
+				ResponseStatus:       grw.responseStatus,
+				ResponseHeader:       w.Header(),
+				ResponseBytes:        grw.bytesWritten,
+				ResponseEnd:          grw.end,
+				Error:                grw.responseError,
+				ClientDisconnected:   grw.disconnected,
+				Panicked:             hp != nil,
+				Shed:                 shed,
+				TimedOut:             grw.timedOut && !grw.disconnected,
+				Fields:               grw.copyFields(),
+			}
+			if v := grw.responseMessage.Load(); v != nil {
+				stats.Message = v.(string)
 			}
 			if er != nil {
 				stats.RequestBody = er.Bytes()
 			}
+			if bb != nil {
+				stats.ResponseBody = bb.Bytes()
+			}
+			if rd := config.Redaction; rd != nil {
+				rd.redactURL(stats.RequestURL)
+				stats.RequestBody = rd.redactBody(stats.RequestBody)
+				stats.ResponseHeader = rd.redactHeaders(stats.ResponseHeader)
+				stats.ResponseBody = rd.redactBody(stats.ResponseBody)
+				stats.Message = rd.redactValue(stats.Message)
+				for key, value := range stats.Fields {
+					stats.Fields[key] = rd.redactValue(value)
+				}
+			}
 			config.Callback(stats)
 		}
 
 		// Update log
-		if config.LogWriter != nil {
-			if (stats != nil && stats.emitLog) || (atomic.LoadUint32(config.LogBitmask))&(1<<uint32(statusClass-1)) > 0 {
+		if config.LogWriter != nil || config.Logger != nil {
+			// Log requests whose status class is selected by the bitmask and
+			// sampling, along with those that are slow, or that the callback
+			// requested be logged.
+			if (atomic.LoadUint32(config.LogBitmask))&(1<<uint32(statusClass-1)) > 0 {
+				grw.sampled, grw.sampleRate = true, samplingScale
+				if config.LogSampleRates != nil {
+					grw.sampled, grw.sampleRate = config.LogSampleRates.sample(statusClass)
+				}
+			}
+			slow := config.LogSlowThreshold > 0 && grw.end.Sub(grw.begin) >= config.LogSlowThreshold
+			if grw.sampled || slow || (stats != nil && stats.emitLog) {
 				grw.requestHeaders = requestHeaders
-				buf := make([]byte, 0, 128)
-				for _, emitter := range emitters {
-					emitter(grw, r, &buf)
+				if config.LogWriter != nil {
+					buf := make([]byte, 0, 128)
+					for _, emitter := range emitters {
+						emitter(grw, r, &buf)
+					}
+					_, _ = config.LogWriter.Write(buf)
+				}
+				if config.Logger != nil {
+					emitSlogRecord(r.Context(), config.Logger, slogEmitters, grw, r, slogLevel(statusClass, hp != nil))
 				}
-				_, _ = config.LogWriter.Write(buf)
 			}
 		}
 
+		// After a timeout or client disconnect the downstream handler may
+		// still be running, and will continue to run after this returns.
+		if grw.timedOut {
+			abandonHandler(config.Counters, grw)
+		}
+
 		// After event has had a chance to be logged, re-panic if panics are
 		// allowed and downstream handler triggered one.
-		if config.AllowPanics && p != nil {
-			panic(p) // repeat the panic raised by downstream handler
+		if config.AllowPanics && hp != nil {
+			panic(hp.value) // repeat the panic raised by downstream handler
+		}
+
+		// When streaming, a timeout or panic after the response has been
+		// committed cannot be reported to the client using a status code.
+		// Abort the connection so the client can detect the truncated
+		// response.
+		if grw.aborted {
+			panic(http.ErrAbortHandler)
 		}
 	})
 }
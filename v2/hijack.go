@@ -0,0 +1,133 @@
+package gohm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errHijackNotSupported is returned when the downstream handler attempts to
+// hijack the client connection, but the http.ResponseWriter gohm wraps does not
+// support it.
+var errHijackNotSupported = errors.New("gohm: underlying http.ResponseWriter does not implement http.Hijacker")
+
+// hijackedConn wraps the net.Conn given to a downstream handler that hijacked
+// the client connection, so gohm can account for the bytes sent in either
+// direction, and detect when the handler closes the connection.
+type hijackedConn struct {
+	// 64-bit values accessed atomically must be first for alignment on 32-bit
+	// platforms.
+	bytesRead    int64
+	bytesWritten int64
+
+	net.Conn
+	closed    chan struct{} // closed is closed after the connection is closed
+	closeOnce sync.Once
+	end       time.Time // end is the time the connection was closed
+}
+
+func (hc *hijackedConn) Read(b []byte) (int, error) {
+	n, err := hc.Conn.Read(b)
+	atomic.AddInt64(&hc.bytesRead, int64(n))
+	return n, err
+}
+
+func (hc *hijackedConn) Write(b []byte) (int, error) {
+	n, err := hc.Conn.Write(b)
+	atomic.AddInt64(&hc.bytesWritten, int64(n))
+	return n, err
+}
+
+// Close closes the client connection, and signals gohm that it may complete
+// logging the request.
+func (hc *hijackedConn) Close() error {
+	err := hc.Conn.Close()
+	hc.closeOnce.Do(func() {
+		hc.end = time.Now()
+		close(hc.closed)
+	})
+	return err
+}
+
+// Hijack lets the downstream handler take over the client connection, for
+// instance to upgrade it to the WebSocket protocol.  Once the connection is
+// hijacked, gohm no longer enforces the handler timeout, so the request context
+// is no longer canceled when the timeout elapses, and gohm waits for the
+// handler to close the connection, or for the request context to be done,
+// before it logs the request, so the logged duration and byte counts cover the
+// entire life of the connection.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	if rw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	if rw.hijacked != nil {
+		return nil, nil, http.ErrHijacked
+	}
+	hj, ok := rw.responseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errHijackNotSupported
+	}
+	if rw.timeoutContext != nil {
+		// The hijacked connection may outlive the timeout, so the timeout
+		// must not cancel the request context the handler keeps using.
+		if !rw.timeoutContext.stopTimeout() {
+			return nil, nil, http.ErrHandlerTimeout
+		}
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		if rw.timeoutContext != nil {
+			rw.timeoutContext.restartTimeout()
+		}
+		return nil, nil, err
+	}
+
+	hc := &hijackedConn{Conn: conn, closed: make(chan struct{})}
+
+	// The server may have already read bytes from the client beyond the
+	// request headers.  Those bytes must be returned to the downstream handler
+	// before any further bytes are read from the connection.
+	var r io.Reader = hc
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n) // cannot fail because n bytes already buffered
+		r = io.MultiReader(bytes.NewReader(buffered), hc)
+		hc.bytesRead = int64(n)
+	}
+
+	rw.hijacked = hc
+	rw.committed = true // too late to send an error response to the client
+	if !rw.wroteHeader {
+		rw.writeHeader(http.StatusSwitchingProtocols)
+	}
+
+	return hc, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(hc)), nil
+}
+
+// hijackComplete waits for the hijacked connection to be closed, then records
+// its statistics for the log.  Because the request is logged only after the
+// connection is closed, this blocks the goroutine serving the request for the
+// life of the connection, which gohm's timeout does not bound.  When the
+// request context is done first, for instance because the context returned by
+// http.Server.BaseContext is canceled while the server shuts down, it stops
+// waiting, and records the statistics of the connection up to that point,
+// while the connection remains open for the downstream handler.
+func (rw *responseWriter) hijackComplete() {
+	select {
+	case <-rw.hijacked.closed:
+		rw.end = rw.hijacked.end
+	case <-rw.requestDone:
+		rw.end = time.Now()
+		rw.responseError = "request context done before hijacked connection was closed"
+	}
+	rw.bytesRead = atomic.LoadInt64(&rw.hijacked.bytesRead)
+	rw.bytesWritten = atomic.LoadInt64(&rw.hijacked.bytesWritten)
+}
@@ -0,0 +1,238 @@
+package gohm_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+// syncBuffer allows a test to read a log written by a handler running in the
+// server's goroutine.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.buf.String()
+}
+
+func TestHijack(t *testing.T) {
+	const upgradeResponse = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"
+
+	logBitmask := gohm.LogStatus1xx
+	logOutput := new(syncBuffer)
+	var counters gohm.Counters
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Handler returns immediately, while another goroutine services the
+		// connection for longer than the timeout.
+		go func() {
+			defer conn.Close()
+			brw.WriteString(upgradeResponse)
+			brw.Flush()
+			time.Sleep(20 * time.Millisecond) // longer than timeout
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			brw.WriteString(line)
+			brw.Flush()
+		}()
+	}), gohm.Config{
+		Counters:   &counters,
+		LogBitmask: &logBitmask,
+		LogFormat:  "{status} {bytes} {hijack-bytes-read} {error}",
+		LogWriter:  logOutput,
+		Timeout:    5 * time.Millisecond,
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusSwitchingProtocols; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	const message = "hello, world\n"
+	fmt.Fprint(conn, message)
+
+	echo, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := echo, message; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	// Request is logged in the server's goroutine after the handler closes
+	// the connection.
+	for deadline := time.Now().Add(time.Second); logOutput.String() == ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("request not logged after connection closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	want := fmt.Sprintf("101 %d %d -\n", len(upgradeResponse)+len(message), len(message))
+	if got := logOutput.String(); got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := counters.Get1xx(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestHijackRequestContextDone(t *testing.T) {
+	logOutput := new(syncBuffer)
+	hijacked := make(chan net.Conn, 1)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hijacked <- conn // connection remains open after handler returns
+	}), gohm.Config{
+		LogFormat: "{status} {error}",
+		LogWriter: logOutput,
+	})
+
+	baseContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.BaseContext = func(net.Listener) context.Context { return baseContext }
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	defer (<-hijacked).Close()
+
+	// Request is not logged while the hijacked connection is open, until the
+	// request context is done.
+	time.Sleep(10 * time.Millisecond)
+	if got, want := logOutput.String(), ""; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	cancel()
+
+	for deadline := time.Now().Add(time.Second); logOutput.String() == ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("request not logged after request context done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := logOutput.String(), "101 request context done before hijacked connection was closed\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestHijackOutlivesTimeout(t *testing.T) {
+	logOutput := new(syncBuffer)
+	contextErr := make(chan error, 1)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		time.Sleep(20 * time.Millisecond) // longer than the timeout
+		if _, ok := r.Context().Deadline(); ok {
+			t.Error("request context ought not have a deadline after hijack")
+		}
+		contextErr <- r.Context().Err()
+	}), gohm.Config{
+		LogFormat: "{status} {error}",
+		LogWriter: logOutput,
+		Timeout:   5 * time.Millisecond,
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	if got := <-contextErr; got != nil {
+		t.Errorf("GOT: %v; WANT: %v", got, nil)
+	}
+
+	for deadline := time.Now().Add(time.Second); logOutput.String() == ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("request not logged after connection closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := logOutput.String(), "101 -\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestHijackNotSupported(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+
+	var hijackErr error
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, hijackErr = w.(http.Hijacker).Hijack()
+	}), gohm.Config{})
+
+	handler.ServeHTTP(recorder, request)
+
+	if got, want := fmt.Sprintf("%v", hijackErr), "does not implement http.Hijacker"; !strings.Contains(got, want) {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
@@ -1,10 +1,11 @@
 package gohm
 
 import (
-	"bytes"
+	"encoding/base64"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
@@ -12,9 +13,32 @@ import (
 // ApacheCommonLogFormat (CLF) is the default log line format for Apache Web
 // Server.  It is included here for users of this library that would like to
 // easily specify log lines out to be emitted using the Apache Common Log Format
-// (CLR), by setting `LogFormat` to `gohm.ApackeCommonLogFormat`.
+// (CLF), by setting `LogFormat` to `gohm.ApacheCommonLogFormat`.
 const ApacheCommonLogFormat = "{client-ip} - - [{begin}] \"{method} {uri} {proto}\" {status} {bytes}"
 
+// ApacheCombinedLogFormat is the Apache Common Log Format, with the user name
+// sent using HTTP Basic authentication, followed by the quoted values of the
+// Referer and User-Agent request headers, which is the format most web log
+// analyzers expect.
+const ApacheCombinedLogFormat = "{client-ip} - {remote-user} [{begin}] \"{request-line}\" {status} {bytes} \"{referer}\" \"{user-agent}\""
+
+// LTSVLogFormat emits log lines in Labeled Tab-separated Values format, using
+// the labels recommended by http://ltsv.org.  Tabs and newlines in values are
+// escaped, so it must not be used with LogEscapeNone.
+const LTSVLogFormat = "time:[{begin}]\thost:{client-ip}\tuser:{remote-user}\treq:{request-line}\tmethod:{method}\turi:{uri}\tprotocol:{proto}\tstatus:{status}\tsize:{bytes}\treferer:{referer}\tua:{user-agent}\tvhost:{host}\treqtime_microsec:{duration-us}"
+
+// W3CExtendedLogFormat emits log lines in the W3C Extended Log File Format.
+// The date and time fields are when the request completed, as the format
+// specifies.  Spaces in values are replaced with plus signs, as IIS does.  The
+// directives that describe the fields, such as "#Fields:", must precede the log
+// lines, and are written by wrapping the LogWriter with NewW3CWriter, or for a
+// RotatingFileWriter, by setting RotatingFileWriterConfig.Header to W3CHeader.
+const W3CExtendedLogFormat = "{end:2006-01-02} {end:15:04:05} {client-ip} {remote-user|w3c} {method} {path|w3c} {query|w3c} {status} {bytes} {duration} {user-agent|w3c} {referer|w3c}"
+
+// w3cFields lists the W3C Extended Log File Format fields, in the order they
+// are emitted by W3CExtendedLogFormat.
+const w3cFields = "date time c-ip cs-username cs-method cs-uri-stem cs-uri-query sc-status sc-bytes time-taken cs(User-Agent) cs(Referer)"
+
 const apacheTimeFormat = "02/Jan/2006:15:04:05 -0700"
 
 // NOTE: Apache Common Log Format size excludes HTTP headers
@@ -46,27 +70,72 @@ const LogStatusAll uint32 = 1 | 2 | 4 | 8 | 16
 // LogStatusErrors used to log HTTP requests which have 4xx or 5xx response
 const LogStatusErrors uint32 = 8 | 16
 
-// compileFormat converts the format string into a slice of functions to invoke
-// when creating a log line.  It's implemented as a state machine that
-// alternates between 2 states: consuming runes to create a constant string to
-// emit, and consuming runes to create a token that is intended to match one of
-// the pre-defined format specifier tokens, or an undefined format specifier
-// token that begins with "http-".
-func compileFormat(format string) ([]func(*responseWriter, *http.Request, *[]byte), []string) {
+// compileFormat converts the parsed log line format into a slice of functions
+// to invoke when creating a log line, and returns the names of the request
+// headers the format refers to, which must be copied before the downstream
+// handler is invoked.  The values of string directives are escaped using the
+// specified escaping, unless the directive has a modifier that specifies
+// otherwise.
+func compileFormat(segments []logSegment, escaping LogEscaping) ([]func(*responseWriter, *http.Request, *[]byte), []string) {
 	// build slice of emitter functions, each will emit the requested
 	// information
 	var emitters []func(*responseWriter, *http.Request, *[]byte)
+	var buf []byte
 
 	hm := make(map[string]struct{})
 
+	for _, segment := range segments {
+		if segment.directive == "" {
+			buf = append(buf, segment.text...)
+			continue
+		}
+		emitter, kind, header := directiveEmitter(segment.directive)
+		emitter = makeDashEmitter(emitter)
+		if kind == stringDirective || segment.modifier != "" {
+			emitter = makeEscapeEmitter(emitter, escaping, segment.modifier)
+		}
+		if len(buf) > 0 {
+			emitters = append(emitters, makeStringEmitter(string(buf)))
+			buf = buf[:0]
+		}
+		if header != "" {
+			hm[header] = struct{}{}
+		}
+		emitters = append(emitters, emitter)
+	}
+
+	buf = append(buf, '\n') // each log line terminated by newline byte
+	emitters = append(emitters, makeStringEmitter(string(buf)))
+
+	return emitters, headerNames(hm)
+}
+
+// scanFormat parses the format string, invoking literal with each run of
+// constant text, and directive with the name of each format specifier token.
+// It's implemented as a state machine that alternates between 2 states:
+// consuming runes to create a constant string to emit, and consuming runes to
+// create a token that is intended to match one of the pre-defined format
+// specifier tokens.  When directive returns false because the token is not
+// defined, the token is passed to literal, wrapped in curly braces.
+//
+// When strict, rather than tolerate them, scanFormat returns a
+// *LogFormatError for the first undefined token, unbalanced curly brace, or
+// escape of a rune other than a curly brace or backslash.  Otherwise it never
+// returns an error.
+func scanFormat(format string, strict bool, literal func([]byte), directive func(string) bool) error {
 	// state machine alternating between two states: either capturing runes for
 	// the next constant buffer, or capturing runes for the next token
 	var buf, token []byte
 	var capturingToken bool  // false, because start off capturing buffer runes
 	var nextRuneEscaped bool // true when next rune has been escaped
+	var escapeOffset int     // byte offset of most recent backslash
+	var tokenOffset int      // byte offset of most recent open curly brace
 
-	for _, rune := range format {
+	for i, rune := range format {
 		if nextRuneEscaped {
+			if strict && rune != '{' && rune != '}' && rune != '\\' {
+				return &LogFormatError{Offset: escapeOffset, Problem: "invalid escape sequence: \\" + string(rune)}
+			}
 			// when this rune has been escaped, then just write it out to
 			// whichever buffer we're collecting to right now
 			if capturingToken {
@@ -81,69 +150,38 @@ func compileFormat(format string) ([]func(*responseWriter, *http.Request, *[]byt
 			// Format specifies that next rune ought to be escaped.  Handy when
 			// extra curly braces are desired in the log line format.
 			nextRuneEscaped = true
+			escapeOffset = i
 			continue
 		}
 		if rune == '{' {
 			// Stop capturing buf, and begin capturing token.
 			// NOTE: undefined behavior if open curly brace when previous open
 			// curly brace has not yet been closed.
-			emitters = append(emitters, makeStringEmitter(string(buf)))
-			buf = buf[:0]
+			if strict && capturingToken {
+				return &LogFormatError{Offset: i, Problem: "open curly brace inside directive"}
+			}
+			tokenOffset = i
+			if len(buf) > 0 {
+				literal(buf)
+				buf = buf[:0]
+			}
 			capturingToken = true
 		} else if rune == '}' {
 			// Stop capturing token, and begin capturing buffer.
 			// NOTE: undefined behavior if close curly brace when not capturing
 			// runes for a token.
-			switch tok := string(token); tok {
-			case "begin":
-				emitters = append(emitters, beginEmitter)
-			case "begin-epoch":
-				emitters = append(emitters, beginEpochEmitter)
-			case "begin-iso8601":
-				emitters = append(emitters, beginISO8601Emitter)
-			case "bytes":
-				emitters = append(emitters, bytesEmitter)
-			case "client":
-				emitters = append(emitters, clientEmitter)
-			case "client-ip":
-				emitters = append(emitters, clientIPEmitter)
-			case "client-port":
-				emitters = append(emitters, clientPortEmitter)
-			case "duration":
-				emitters = append(emitters, durationEmitter)
-			case "end":
-				emitters = append(emitters, endEmitter)
-			case "end-epoch":
-				emitters = append(emitters, endEpochEmitter)
-			case "end-iso8601":
-				emitters = append(emitters, endISO8601Emitter)
-			case "error":
-				emitters = append(emitters, errorMessageEmitter)
-			case "message":
-				emitters = append(emitters, messageEmitter)
-			case "method":
-				emitters = append(emitters, methodEmitter)
-			case "proto":
-				emitters = append(emitters, protoEmitter)
-			case "status":
-				emitters = append(emitters, statusEmitter)
-			case "status-text":
-				emitters = append(emitters, statusTextEmitter)
-			case "uri":
-				emitters = append(emitters, uriEmitter)
-			default:
-				if strings.HasPrefix(tok, "http-") {
-					// emit value of specified HTTP request header
-					header := tok[5:]
-					hm[header] = struct{}{}
-					emitters = append(emitters, makeHeaderEmitter(header))
-				} else {
-					// unknown token: just append to buf, wrapped in curly
-					// braces
-					buf = append(buf, '{')
-					buf = append(buf, tok...)
-					buf = append(buf, '}')
+			if strict && !capturingToken {
+				return &LogFormatError{Offset: i, Problem: "close curly brace without matching open curly brace"}
+			}
+			if tok := string(token); !directive(tok) {
+				if strict {
+					return &LogFormatError{Offset: tokenOffset, Problem: "unknown directive: {" + tok + "}"}
 				}
+				// unknown token: just append to buf, wrapped in curly
+				// braces
+				buf = append(buf, '{')
+				buf = append(buf, tok...)
+				buf = append(buf, '}')
 			}
 			token = token[:0]
 			capturingToken = false
@@ -156,13 +194,149 @@ func compileFormat(format string) ([]func(*responseWriter, *http.Request, *[]byt
 			}
 		}
 	}
+	if strict {
+		if nextRuneEscaped {
+			return &LogFormatError{Offset: escapeOffset, Problem: "backslash at end of format"}
+		}
+		if capturingToken {
+			return &LogFormatError{Offset: tokenOffset, Problem: "directive without close curly brace"}
+		}
+	}
 	if capturingToken {
 		buf = append(buf, '{') // token started with left curly brace, so it needs to precede the token
 		buf = append(buf, token...)
 	}
-	buf = append(buf, '\n') // each log line terminated by newline byte
-	emitters = append(emitters, makeStringEmitter(string(buf)))
+	if len(buf) > 0 {
+		literal(buf)
+	}
+	return nil
+}
+
+// Kinds of values emitted by directives, which determine how they are encoded
+// in JSON log lines.
+const (
+	stringDirective = iota // stringDirective values are encoded as JSON strings
+	numberDirective        // numberDirective values are encoded as JSON numbers
+	boolDirective          // boolDirective values are encoded as JSON booleans
+)
+
+// directiveEmitter returns the emitter for the specified format specifier
+// token, the kind of value it emits, and for tokens that refer to a request
+// header, the name of the header.  It returns a nil emitter when the token is
+// not defined.
+func directiveEmitter(tok string) (func(*responseWriter, *http.Request, *[]byte), int, string) {
+	switch tok {
+	case "begin":
+		return beginEmitter, stringDirective, ""
+	case "begin-epoch":
+		return beginEpochEmitter, numberDirective, ""
+	case "begin-iso8601":
+		return beginISO8601Emitter, stringDirective, ""
+	case "bytes":
+		return bytesEmitter, numberDirective, ""
+	case "client":
+		return clientEmitter, stringDirective, ""
+	case "client-ip":
+		return clientIPEmitter, stringDirective, ""
+	case "client-port":
+		return clientPortEmitter, stringDirective, ""
+	case "duration":
+		return durationEmitter, numberDirective, ""
+	case "duration-ms":
+		return makeDurationEmitter(time.Millisecond), numberDirective, ""
+	case "duration-ns":
+		return makeDurationEmitter(time.Nanosecond), numberDirective, ""
+	case "duration-us":
+		return makeDurationEmitter(time.Microsecond), numberDirective, ""
+	case "end":
+		return endEmitter, stringDirective, ""
+	case "end-epoch":
+		return endEpochEmitter, numberDirective, ""
+	case "end-iso8601":
+		return endISO8601Emitter, stringDirective, ""
+	case "error":
+		return errorMessageEmitter, stringDirective, ""
+	case "hijack-bytes-read":
+		return hijackBytesReadEmitter, numberDirective, ""
+	case "host":
+		return hostEmitter, stringDirective, ""
+	case "message":
+		return messageEmitter, stringDirective, ""
+	case "panic":
+		return panicEmitter, stringDirective, ""
+	case "panic-stack":
+		return panicStackEmitter, stringDirective, ""
+	case "path":
+		return pathEmitter, stringDirective, ""
+	case "method":
+		return methodEmitter, stringDirective, ""
+	case "proto":
+		return protoEmitter, stringDirective, ""
+	case "query":
+		return queryEmitter, stringDirective, ""
+	case "referer":
+		return makeHeaderEmitter("Referer"), stringDirective, "Referer"
+	case "remote-user":
+		return remoteUserEmitter, stringDirective, "Authorization"
+	case "request-bytes":
+		return requestBytesEmitter, numberDirective, ""
+	case "request-id":
+		return requestIDEmitter, stringDirective, ""
+	case "request-line":
+		return requestLineEmitter, stringDirective, ""
+	case "sample-rate":
+		return sampleRateEmitter, numberDirective, ""
+	case "sampled":
+		return sampledEmitter, boolDirective, ""
+	case "status":
+		return statusEmitter, numberDirective, ""
+	case "status-text":
+		return statusTextEmitter, stringDirective, ""
+	case "timeout":
+		return timeoutEmitter, numberDirective, ""
+	case "uri":
+		return uriEmitter, stringDirective, ""
+	case "user-agent":
+		return makeHeaderEmitter("User-Agent"), stringDirective, "User-Agent"
+	}
+	if strings.HasPrefix(tok, "begin:") {
+		// emit begin time formatted with specified layout
+		return makeTimeEmitter(false, tok[6:]), stringDirective, ""
+	}
+	if strings.HasPrefix(tok, "end:") {
+		// emit end time formatted with specified layout
+		return makeTimeEmitter(true, tok[4:]), stringDirective, ""
+	}
+	if strings.HasPrefix(tok, "resp-http-") {
+		// emit value of specified HTTP response header
+		return makeResponseHeaderEmitter(tok[10:]), stringDirective, ""
+	}
+	if strings.HasPrefix(tok, "http-") {
+		// emit value of specified HTTP request header
+		header := tok[5:]
+		return makeHeaderEmitter(header), stringDirective, header
+	}
+	if strings.HasPrefix(tok, "field-") {
+		// emit value of specified field set by Annotate
+		return makeFieldEmitter(tok[6:]), stringDirective, ""
+	}
+	return nil, 0, ""
+}
 
+// responseHeaderNames returns the names of the response headers the parsed log
+// format refers to, which must be copied when gohm sends the response.
+func responseHeaderNames(segments []logSegment) []string {
+	hm := make(map[string]struct{})
+	for _, segment := range segments {
+		if strings.HasPrefix(segment.directive, "resp-http-") {
+			hm[segment.directive[10:]] = struct{}{}
+		}
+	}
+	return headerNames(hm)
+}
+
+// headerNames returns the names of the headers in the specified set.
+func headerNames(hm map[string]struct{}) []string {
 	var headers []string
 	if l := len(hm); l > 0 {
 		headers = make([]string, 0, l)
@@ -170,7 +344,7 @@ func compileFormat(format string) ([]func(*responseWriter, *http.Request, *[]byt
 			headers = append(headers, header)
 		}
 	}
-	return emitters, headers
+	return headers
 }
 
 func makeStringEmitter(value string) func(*responseWriter, *http.Request, *[]byte) {
@@ -195,26 +369,20 @@ func bytesEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
 	*bb = append(*bb, strconv.FormatInt(grw.bytesWritten, 10)...)
 }
 
-func clientEmitter(_ *responseWriter, r *http.Request, bb *[]byte) {
-	*bb = append(*bb, r.RemoteAddr...)
+func hijackBytesReadEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, strconv.FormatInt(grw.bytesRead, 10)...)
 }
 
-func clientIPEmitter(_ *responseWriter, r *http.Request, bb *[]byte) {
-	value := []byte(r.RemoteAddr) // "ipv4:port", or "[ipv6]:port"
-	// strip port
-	if colon := bytes.LastIndexByte(value, ':'); colon != -1 {
-		value = value[:colon]
-	}
-	// strip square brackets
-	if l := len(value); l > 2 && value[0] == '[' && value[l-1] == ']' {
-		value = value[1 : l-1]
-	}
-	// append remaining bytes
-	*bb = append(*bb, value...)
+func clientEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.requestRemoteAddr...)
 }
 
-func clientPortEmitter(_ *responseWriter, r *http.Request, bb *[]byte) {
-	value := r.RemoteAddr // ip:port
+func clientIPEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, clientIP(grw.requestRemoteAddr)...)
+}
+
+func clientPortEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	value := grw.requestRemoteAddr // ip:port
 	if colon := strings.LastIndex(value, ":"); colon != -1 {
 		value = value[colon+1:]
 	}
@@ -226,6 +394,12 @@ func durationEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
 	*bb = append(*bb, strconv.FormatFloat(grw.end.Sub(grw.begin).Seconds(), 'f', 6, 64)...)
 }
 
+func makeDurationEmitter(unit time.Duration) func(*responseWriter, *http.Request, *[]byte) {
+	return func(grw *responseWriter, _ *http.Request, bb *[]byte) {
+		*bb = strconv.AppendInt(*bb, int64(grw.end.Sub(grw.begin)/unit), 10)
+	}
+}
+
 func endEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
 	*bb = append(*bb, grw.end.UTC().Format(apacheTimeFormat)...)
 }
@@ -241,26 +415,91 @@ func endISO8601Emitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
 func errorMessageEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
 	if grw.responseError != "" {
 		*bb = append(*bb, grw.responseError...)
-	} else {
-		*bb = append(*bb, '-')
+	}
+}
+
+func makeFieldEmitter(key string) func(*responseWriter, *http.Request, *[]byte) {
+	return func(grw *responseWriter, _ *http.Request, bb *[]byte) {
+		if value, ok := grw.field(key); ok && value != "" {
+			*bb = append(*bb, grw.redaction.redactValue(value)...)
+		}
 	}
 }
 
 func messageEmitter(w *responseWriter, _ *http.Request, bb *[]byte) {
 	v := w.responseMessage.Load()
 	if v != nil {
-		*bb = append(*bb, v.(string)...)
-	} else {
-		*bb = append(*bb, '-')
+		*bb = append(*bb, w.redaction.redactValue(v.(string))...)
+	}
+}
+
+func methodEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.requestMethod...)
+}
+
+func panicEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	if grw.panicValue != "" {
+		*bb = append(*bb, grw.panicValue...)
 	}
 }
 
-func methodEmitter(_ *responseWriter, r *http.Request, bb *[]byte) {
-	*bb = append(*bb, r.Method...)
+func panicStackEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	if grw.panicStack != "" {
+		*bb = append(*bb, grw.panicStack...)
+	}
 }
 
-func protoEmitter(_ *responseWriter, r *http.Request, bb *[]byte) {
-	*bb = append(*bb, r.Proto...)
+func protoEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.requestProto...)
+}
+
+// remoteUserEmitter emits the user name from the Basic authentication
+// credentials of the request, like the %u directive of Apache Web Server.  The
+// credentials are not verified, so the user name is not necessarily that of an
+// authenticated user.
+func remoteUserEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, basicAuthUser(grw.requestHeaders["Authorization"])...)
+}
+
+// basicAuthUser returns the user name from the specified Authorization header
+// value, or the empty string when it does not hold Basic authentication
+// credentials.
+func basicAuthUser(authorization string) string {
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return ""
+	}
+	credentials, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return ""
+	}
+	user, _, ok := strings.Cut(string(credentials), ":")
+	if !ok {
+		return ""
+	}
+	return user
+}
+
+func requestLineEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.requestMethod...)
+	*bb = append(*bb, ' ')
+	*bb = append(*bb, grw.redaction.redactURI(grw.requestURI)...)
+	*bb = append(*bb, ' ')
+	*bb = append(*bb, grw.requestProto...)
+}
+
+func requestIDEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	if grw.requestID != "" {
+		*bb = append(*bb, grw.requestID...)
+	}
+}
+
+func sampledEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = strconv.AppendBool(*bb, grw.sampled)
+}
+
+func sampleRateEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = strconv.AppendFloat(*bb, float64(grw.sampleRate)/samplingScale, 'f', -1, 64)
 }
 
 func statusEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
@@ -271,13 +510,81 @@ func statusTextEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
 	*bb = append(*bb, http.StatusText(grw.responseStatus)...)
 }
 
-func uriEmitter(_ *responseWriter, r *http.Request, bb *[]byte) {
-	*bb = append(*bb, r.RequestURI...)
+func timeoutEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	if grw.timeout > 0 {
+		// 6 decimal places: microsecond precision, the same as duration
+		*bb = append(*bb, strconv.FormatFloat(grw.timeout.Seconds(), 'f', 6, 64)...)
+	}
+}
+
+func uriEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.redaction.redactURI(grw.requestURI)...)
+}
+
+func hostEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.requestHost...)
+}
+
+func pathEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.redaction.redactValue(grw.requestPath)...)
+}
+
+func queryEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	*bb = append(*bb, grw.redaction.redactQuery(grw.requestQuery)...)
+}
+
+func requestBytesEmitter(grw *responseWriter, _ *http.Request, bb *[]byte) {
+	var n int64
+	if grw.requestBody != nil {
+		n = atomic.LoadInt64(&grw.requestBody.n)
+	}
+	*bb = strconv.AppendInt(*bb, n, 10)
 }
 
 func makeHeaderEmitter(headerName string) func(*responseWriter, *http.Request, *[]byte) {
 	return func(grw *responseWriter, _ *http.Request, bb *[]byte) {
-		*bb = append(*bb, grw.requestHeaders[headerName]...)
+		if value := grw.requestHeaders[headerName]; value != "" {
+			*bb = append(*bb, grw.redaction.redactHeader(headerName, value)...)
+		}
+	}
+}
+
+// makeResponseHeaderEmitter returns an emitter for the value of the specified
+// response header.  It emits the value gohm sent to the client, which was
+// copied when the response was sent, rather than reading the headers of the
+// downstream handler, which may still be running after a timeout, or of the
+// underlying http.ResponseWriter, which must not be used after the request has
+// been answered.
+func makeResponseHeaderEmitter(headerName string) func(*responseWriter, *http.Request, *[]byte) {
+	return func(grw *responseWriter, _ *http.Request, bb *[]byte) {
+		if value := grw.sentHeaders[headerName]; value != "" {
+			*bb = append(*bb, grw.redaction.redactHeader(headerName, value)...)
+		}
+	}
+}
+
+// makeTimeEmitter returns an emitter for the begin or end time of the request,
+// in UTC, formatted with the specified layout.
+func makeTimeEmitter(end bool, layout string) func(*responseWriter, *http.Request, *[]byte) {
+	return func(grw *responseWriter, _ *http.Request, bb *[]byte) {
+		t := grw.begin
+		if end {
+			t = grw.end
+		}
+		*bb = t.UTC().AppendFormat(*bb, layout)
+	}
+}
+
+// makeDashEmitter returns an emitter that emits the value emitted by the
+// specified emitter, or a hyphen when it emits nothing, because the directive
+// has no value, such as when a request header is not present.
+func makeDashEmitter(emitter func(*responseWriter, *http.Request, *[]byte)) func(*responseWriter, *http.Request, *[]byte) {
+	return func(grw *responseWriter, r *http.Request, bb *[]byte) {
+		start := len(*bb)
+		emitter(grw, r, bb)
+		if len(*bb) == start {
+			*bb = append(*bb, '-')
+		}
 	}
 }
 
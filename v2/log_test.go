@@ -3,8 +3,10 @@ package gohm_test
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -304,6 +306,219 @@ func TestLogWithHTTPHeader(t *testing.T) {
 	}
 }
 
+func TestLogWithFormatRequestDetails(t *testing.T) {
+	format := "{host} {path} {query} {referer} {user-agent} {request-bytes} {resp-http-Content-Type} {resp-http-X-Missing}"
+	logOutput := new(bytes.Buffer)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "http://example.com/some/url?a=1&b=2", strings.NewReader("some request body"))
+	request.Header.Set("Referer", "http://example.com/previous")
+	request.Header.Set("User-Agent", "test-agent/1.0")
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = "/modified" // must not affect log
+		buf := make([]byte, 4)
+		io.ReadFull(r.Body, buf)
+		w.Header().Set("Content-Type", "text/plain")
+	}), gohm.Config{LogFormat: format, LogWriter: logOutput})
+
+	handler.ServeHTTP(recorder, request)
+
+	want := "example.com /some/url a=1&b=2 http://example.com/previous test-agent/1.0 4 text/plain -\n"
+	if got := logOutput.String(); got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogWithFormatMissingRequestDetails(t *testing.T) {
+	format := "{query} {referer} {user-agent} {request-bytes}"
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), gohm.Config{LogFormat: format, LogWriter: logOutput})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+
+	if got, want := logOutput.String(), "- - - 0\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogWithFormatDurationUnitsAndLayouts(t *testing.T) {
+	format := "{duration-ms} {duration-us} {duration-ns} {begin:2006-01-02} {end:15:04\\}}"
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+	}), gohm.Config{LogFormat: format, LogWriter: logOutput})
+
+	before := time.Now().UTC()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+	after := time.Now().UTC()
+
+	fields := strings.Fields(logOutput.String())
+	if got, want := len(fields), 5; got != want {
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+
+	var durations [3]int64
+	for i := range durations {
+		d, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		durations[i] = d
+	}
+	if durations[0] < 2 {
+		t.Errorf("GOT: %v; WANT: >= 2", durations[0])
+	}
+	if got, want := durations[1]/1000, durations[0]; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := durations[2]/1000, durations[1]; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	if got := fields[3]; got != before.Format("2006-01-02") && got != after.Format("2006-01-02") {
+		t.Errorf("GOT: %v; WANT: %v", got, after.Format("2006-01-02"))
+	}
+	if got := fields[4]; got != before.Format("15:04}") && got != after.Format("15:04}") {
+		t.Errorf("GOT: %v; WANT: %v", got, after.Format("15:04}"))
+	}
+}
+
+// presetRequest returns a request with the details logged by the log format
+// presets, including values that need to be escaped.
+func presetRequest() *http.Request {
+	request := httptest.NewRequest("GET", "/some/url?a=b", nil)
+	request.SetBasicAuth("alice", "secret")
+	request.Header.Set("Referer", "https://example.com/")
+	request.Header.Set("User-Agent", "Mozilla/5.0 (X11) \"quoted\"\tagent")
+	return request
+}
+
+func logPreset(t *testing.T, format string) string {
+	t.Helper()
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), gohm.Config{LogFormat: format, LogWriter: logOutput})
+
+	handler.ServeHTTP(httptest.NewRecorder(), presetRequest())
+
+	return logOutput.String()
+}
+
+func TestLogWithApacheCommonLogFormat(t *testing.T) {
+	line := logPreset(t, gohm.ApacheCommonLogFormat)
+
+	// Pattern used by Apache log parsers, such as the COMMONAPACHELOG pattern of
+	// Logstash.
+	re := regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-)\n$`)
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("GOT: %q; WANT: Common Log Format", line)
+	}
+	want := []string{"192.0.2.1", "-", "-", "", "GET", "/some/url?a=b", "HTTP/1.1", "200", "5"}
+	for i, w := range want {
+		if i == 3 {
+			if _, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[4]); err != nil {
+				t.Errorf("GOT: %v; WANT: %v", err, nil)
+			}
+			continue
+		}
+		if got := m[i+1]; got != w {
+			t.Errorf("GOT: %v; WANT: %v", got, w)
+		}
+	}
+}
+
+func TestLogWithApacheCombinedLogFormat(t *testing.T) {
+	line := logPreset(t, gohm.ApacheCombinedLogFormat)
+
+	// Pattern used by Apache log parsers, such as the COMBINEDAPACHELOG pattern
+	// of Logstash, whose quoted strings may contain escaped quotation marks.
+	re := regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"\n$`)
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("GOT: %q; WANT: Combined Log Format", line)
+	}
+	if got, want := m[3], "alice"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := m[5], "GET /some/url?a=b HTTP/1.1"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := m[8], "https://example.com/"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := m[9], `Mozilla/5.0 (X11) \"quoted\"\tagent`; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestLogWithApacheCombinedLogFormatMissingDetails(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), gohm.Config{LogFormat: gohm.ApacheCombinedLogFormat, LogWriter: logOutput})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got, want := logOutput.String(), `" 204 0 "-" "-"`+"\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("GOT: %v; WANT: suffix %v", got, want)
+	}
+	if got, want := logOutput.String(), "192.0.2.1 - - ["; !strings.HasPrefix(got, want) {
+		t.Errorf("GOT: %v; WANT: prefix %v", got, want)
+	}
+}
+
+func TestLogWithLTSVLogFormat(t *testing.T) {
+	line := logPreset(t, gohm.LTSVLogFormat)
+	if !strings.HasSuffix(line, "\n") {
+		t.Fatalf("GOT: %q; WANT: newline terminated", line)
+	}
+
+	// Parse the line as described by the LTSV specification: fields are
+	// separated by tabs, and each label is separated from its value by the
+	// first colon.
+	label := regexp.MustCompile(`^[0-9A-Za-z_.-]+$`)
+	values := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimSuffix(line, "\n"), "\t") {
+		l, value, ok := strings.Cut(field, ":")
+		if !ok || !label.MatchString(l) {
+			t.Fatalf("GOT: %q; WANT: label:value", field)
+		}
+		values[l] = value
+	}
+
+	want := map[string]string{
+		"host":     "192.0.2.1",
+		"user":     "alice",
+		"req":      "GET /some/url?a=b HTTP/1.1",
+		"method":   "GET",
+		"uri":      "/some/url?a=b",
+		"protocol": "HTTP/1.1",
+		"status":   "200",
+		"size":     "5",
+		"referer":  "https://example.com/",
+		"ua":       `Mozilla/5.0 (X11) \"quoted\"\tagent`,
+		"vhost":    "example.com",
+	}
+	for l, w := range want {
+		if got := values[l]; got != w {
+			t.Errorf("%s: GOT: %v; WANT: %v", l, got, w)
+		}
+	}
+	if _, err := strconv.ParseInt(values["reqtime_microsec"], 10, 64); err != nil {
+		t.Errorf("GOT: %v; WANT: %v", err, nil)
+	}
+	if _, err := time.Parse("[02/Jan/2006:15:04:05 -0700]", values["time"]); err != nil {
+		t.Errorf("GOT: %v; WANT: %v", err, nil)
+	}
+}
+
 func BenchmarkWithLogsElided(b *testing.B) {
 	logBitmask := gohm.LogStatusErrors
 	logOutput := new(bytes.Buffer)
@@ -0,0 +1,168 @@
+package gohm
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// LogEscaping specifies how text log lines escape the values of directives, so
+// a client cannot forge log lines or send terminal control sequences to the
+// person reading the log by including them in a request.
+type LogEscaping int
+
+const (
+	// LogEscapeApache escapes values the way Apache Web Server does: quotation
+	// marks and backslashes are preceded by a backslash, newlines, carriage
+	// returns, and tabs are written as \n, \r, and \t, and other control
+	// characters and bytes that are not valid UTF-8 are written as \xHH.  This
+	// is the default.
+	LogEscapeApache LogEscaping = iota
+
+	// LogEscapeJSON escapes values the way they are escaped inside JSON
+	// strings, writing control characters as \u00HH, and replacing bytes that
+	// are not valid UTF-8 with the Unicode replacement character.
+	LogEscapeJSON
+
+	// LogEscapeNone emits values as they were received.  Only use it when
+	// every value in the log is known to be safe, or the log is not read by
+	// people or line oriented tools.
+	LogEscapeNone
+)
+
+// Modifiers that may follow a directive name after a vertical bar, e.g.,
+// {uri|raw}, to choose how that directive's value is escaped in text log lines.
+const (
+	modifierApache = "apache" // escape value like LogEscapeApache
+	modifierJSON   = "json"   // escape value like LogEscapeJSON
+	modifierQuote  = "quote"  // enclose escaped value in quotation marks
+	modifierRaw    = "raw"    // do not escape value
+	modifierW3C    = "w3c"    // escape value like LogEscapeApache, replacing spaces with plus signs
+)
+
+// splitModifier splits the specified format specifier token into its directive
+// name and modifier, if any.  It returns false when the modifier is not
+// defined.
+func splitModifier(tok string) (string, string, bool) {
+	bar := strings.LastIndexByte(tok, '|')
+	if bar == -1 {
+		return tok, "", true
+	}
+	switch modifier := tok[bar+1:]; modifier {
+	case modifierApache, modifierJSON, modifierQuote, modifierRaw, modifierW3C:
+		return tok[:bar], modifier, true
+	}
+	return tok, "", false
+}
+
+// makeEscapeEmitter returns an emitter that emits the value emitted by the
+// specified emitter, escaped as directed by the specified escaping and
+// modifier.  The value is emitted directly into the log line, then escaped in
+// place, so values that need no escaping are not copied.
+func makeEscapeEmitter(emitter func(*responseWriter, *http.Request, *[]byte), escaping LogEscaping, modifier string) func(*responseWriter, *http.Request, *[]byte) {
+	switch modifier {
+	case modifierApache:
+		escaping = LogEscapeApache
+	case modifierW3C:
+		return makeW3CEmitter(emitter)
+	case modifierJSON:
+		escaping = LogEscapeJSON
+	case modifierRaw:
+		return emitter
+	}
+	quote := modifier == modifierQuote
+	if escaping == LogEscapeNone {
+		if !quote {
+			return emitter
+		}
+		// A quoted value must be escaped, or it may contain a quotation mark
+		// that ends it.
+		escaping = LogEscapeApache
+	}
+
+	return func(grw *responseWriter, r *http.Request, bb *[]byte) {
+		if quote {
+			*bb = append(*bb, '"')
+		}
+		start := len(*bb)
+		emitter(grw, r, bb)
+
+		if escaping != LogEscapeNone {
+			if value := (*bb)[start:]; needsEscape(value) {
+				value = append([]byte(nil), value...) // copy, because it is escaped into the same buffer
+				if escaping == LogEscapeJSON {
+					*bb = appendJSONEscaped((*bb)[:start], value)
+				} else {
+					*bb = appendApacheEscaped((*bb)[:start], value)
+				}
+			}
+		}
+		if quote {
+			*bb = append(*bb, '"')
+		}
+	}
+}
+
+// makeW3CEmitter returns an emitter that emits the value emitted by the
+// specified emitter escaped like LogEscapeApache, with spaces replaced by plus
+// signs, so the value remains a single field of a W3C Extended Log File Format
+// log line.
+func makeW3CEmitter(emitter func(*responseWriter, *http.Request, *[]byte)) func(*responseWriter, *http.Request, *[]byte) {
+	emitter = makeEscapeEmitter(emitter, LogEscapeApache, "")
+	return func(grw *responseWriter, r *http.Request, bb *[]byte) {
+		start := len(*bb)
+		emitter(grw, r, bb)
+		value := (*bb)[start:]
+		for i, b := range value {
+			if b == ' ' {
+				value[i] = '+'
+			}
+		}
+	}
+}
+
+// appendApacheEscaped appends the specified value to buf, escaped the way
+// Apache Web Server escapes values in its logs.  Unlike Apache, it does not
+// escape printable runes that are not ASCII, so they remain legible, but it
+// does escape C1 control characters and the Unicode line and paragraph
+// separators, byte by byte.
+func appendApacheEscaped(buf, value []byte) []byte {
+	for i := 0; i < len(value); {
+		b := value[i]
+		if b < utf8.RuneSelf {
+			switch {
+			case b == '"' || b == '\\':
+				buf = append(buf, '\\', b)
+			case b == '\n':
+				buf = append(buf, '\\', 'n')
+			case b == '\r':
+				buf = append(buf, '\\', 'r')
+			case b == '\t':
+				buf = append(buf, '\\', 't')
+			case b < ' ' || b == 0x7f:
+				buf = append(buf, '\\', 'x', hexDigits[b>>4], hexDigits[b&0xF])
+			default:
+				buf = append(buf, b)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(value[i:])
+		if r == utf8.RuneError && size == 1 || isUnsafeRune(r) {
+			for _, b := range value[i : i+size] {
+				buf = append(buf, '\\', 'x', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+		} else {
+			buf = append(buf, value[i:i+size]...)
+		}
+		i += size
+	}
+	return buf
+}
+
+// isUnsafeRune returns true for runes that are not ASCII, but which terminals
+// or log readers might interpret as control characters or line breaks: the C1
+// control characters and the Unicode line and paragraph separators.
+func isUnsafeRune(r rune) bool {
+	return r >= 0x80 && r <= 0x9f || r == '\u2028' || r == '\u2029'
+}
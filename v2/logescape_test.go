@@ -0,0 +1,121 @@
+package gohm_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/karrick/gohm/v2"
+)
+
+// hostileUserAgent attempts to forge a log line, and to change the color of a
+// terminal displaying the log.
+const hostileUserAgent = "curl\r\n127.0.0.1 \"GET /admin\" 200\x1b[31m\\"
+
+func logUserAgent(t *testing.T, format string, escaping gohm.LogEscaping, userAgent string) string {
+	t.Helper()
+	logOutput := new(bytes.Buffer)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+	request.Header.Set("User-Agent", userAgent)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), gohm.Config{
+		LogEscaping: escaping,
+		LogFormat:   format,
+		LogWriter:   logOutput,
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	return logOutput.String()
+}
+
+func TestLogEscapingApache(t *testing.T) {
+	got := logUserAgent(t, "{user-agent} {status}", gohm.LogEscapeApache, hostileUserAgent)
+	want := "curl\\r\\n127.0.0.1 \\\"GET /admin\\\" 200\\x1b[31m\\\\ 200\n"
+	if got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogEscapingApacheNonASCII(t *testing.T) {
+	// Printable runes remain legible, while invalid UTF-8, C1 control
+	// characters, and line separators are escaped byte by byte.
+	got := logUserAgent(t, "{user-agent}", gohm.LogEscapeApache, "😛 \xff \u009b \u2028")
+	want := "😛 \\xff \\xc2\\x9b \\xe2\\x80\\xa8\n"
+	if got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogEscapingJSON(t *testing.T) {
+	got := logUserAgent(t, "{user-agent}", gohm.LogEscapeJSON, hostileUserAgent+"\xff\u009b")
+	want := "curl\\r\\n127.0.0.1 \\\"GET /admin\\\" 200\\u001b[31m\\\\\\ufffd\\u009b\n"
+	if got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogEscapingNone(t *testing.T) {
+	got := logUserAgent(t, "{user-agent}", gohm.LogEscapeNone, hostileUserAgent)
+	want := hostileUserAgent + "\n"
+	if got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogEscapingModifiers(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"{user-agent|raw}", "a\"b\x1b\n"},
+		{"{user-agent|apache}", "a\\\"b\\x1b\n"},
+		{"{user-agent|json}", "a\\\"b\\u001b\n"},
+		{"{user-agent|quote}", "\"a\\\"b\\x1b\"\n"},
+		{"{http-User-Agent|quote} {status|quote}", "\"a\\\"b\\x1b\" \"200\"\n"},
+		{"{referer|quote}", "\"-\"\n"},
+		{"{user-agent|bogus}", "{user-agent|bogus}\n"},
+	}
+	for _, test := range tests {
+		if got := logUserAgent(t, test.format, gohm.LogEscapeNone, "a\"b\x1b"); got != test.want {
+			t.Errorf("%s: GOT: %q; WANT: %q", test.format, got, test.want)
+		}
+	}
+}
+
+func TestLogEscapingModifiersIgnoredByJSON(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+	request.Header.Set("User-Agent", "a\"b\x1b")
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), gohm.Config{
+		LogFormat: "{user-agent|raw} {status|quote}",
+		LogJSON:   true,
+		LogWriter: logOutput,
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	if got, want := logOutput.String(), `{"user-agent":"a\"b\u001b","status":200}`+"\n"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestCompileLogFormatModifiers(t *testing.T) {
+	if _, err := gohm.CompileLogFormat("{uri|raw} {http-User-Agent|quote} {status|json}"); err != nil {
+		t.Errorf("GOT: %v; WANT: %v", err, nil)
+	}
+	_, err := gohm.CompileLogFormat("{status} {uri|bogus}")
+	if got, want := err.Error(), "gohm: invalid log format at offset 9: unknown directive: {uri|bogus}"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package gohm
+
+import "strconv"
+
+// LogFormat is a log line format that has been parsed and validated by
+// CompileLogFormat, and may be used by any number of handlers by setting
+// Config.CompiledLogFormat.  Handlers use the parsed format rather than
+// parsing it again.
+type LogFormat struct {
+	format   string
+	segments []logSegment
+}
+
+// logSegment is one part of a parsed log line format: either constant text, or
+// a directive with its optional modifier.
+type logSegment struct {
+	text      string // text is the constant text, when directive is empty
+	directive string
+	modifier  string
+}
+
+// parseLogFormat parses the specified log line format into its constant text
+// and directives.  When strict, it returns a *LogFormatError for the first
+// problem found.  Otherwise, like Config.LogFormat, it treats undefined
+// directives as constant text, and never returns an error.
+func parseLogFormat(format string, strict bool) ([]logSegment, error) {
+	var segments []logSegment
+	err := scanFormat(format, strict, func(literal []byte) {
+		if n := len(segments); n > 0 && segments[n-1].directive == "" {
+			segments[n-1].text += string(literal)
+			return
+		}
+		segments = append(segments, logSegment{text: string(literal)})
+	}, func(tok string) bool {
+		directive, modifier, ok := splitModifier(tok)
+		if !ok {
+			return false
+		}
+		if emitter, _, _ := directiveEmitter(directive); emitter == nil {
+			return false
+		}
+		segments = append(segments, logSegment{directive: directive, modifier: modifier})
+		return true
+	})
+	return segments, err
+}
+
+// CompileLogFormat validates the specified log line format, returning a
+// *LogFormatError describing the first problem found, such as an unknown
+// directive, an unbalanced curly brace, or an invalid escape sequence.  Unlike
+// Config.LogFormat, which treats such problems as constant text, it allows
+// programs to detect mistakes in a log format when they start, for instance,
+// when the format is read from a configuration file.
+//
+//	format, err := gohm.CompileLogFormat(os.Getenv("LOG_FORMAT"))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	h := gohm.New(someHandler, gohm.Config{
+//		CompiledLogFormat: format,
+//		LogWriter:         os.Stderr,
+//	})
+func CompileLogFormat(format string) (*LogFormat, error) {
+	segments, err := parseLogFormat(format, true)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFormat{format: format, segments: segments}, nil
+}
+
+// MustCompileLogFormat is like CompileLogFormat, but panics when the specified
+// log line format is not valid.  It simplifies initialization of global
+// variables holding log formats.
+func MustCompileLogFormat(format string) *LogFormat {
+	lf, err := CompileLogFormat(format)
+	if err != nil {
+		panic(err)
+	}
+	return lf
+}
+
+// String returns the log line format that was compiled.
+func (lf *LogFormat) String() string { return lf.format }
+
+// LogFormatError is returned by CompileLogFormat when a log line format is not
+// valid.
+type LogFormatError struct {
+	// Offset is the byte offset in the format where the problem begins.
+	Offset int
+
+	// Problem describes what is wrong with the format.
+	Problem string
+}
+
+func (e *LogFormatError) Error() string {
+	return "gohm: invalid log format at offset " + strconv.Itoa(e.Offset) + ": " + e.Problem
+}
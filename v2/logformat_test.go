@@ -0,0 +1,95 @@
+package gohm_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestCompileLogFormatValid(t *testing.T) {
+	formats := []string{
+		"",
+		gohm.DefaultLogFormat,
+		gohm.ApacheCommonLogFormat,
+		"no directives",
+		"\\{literal\\} \\\\ {status}",
+		"{http-X-Request-Id} {field-user} {resp-http-Content-Type} {begin:2006-01-02}",
+	}
+	for _, format := range formats {
+		lf, err := gohm.CompileLogFormat(format)
+		if err != nil {
+			t.Errorf("%q: GOT: %v; WANT: %v", format, err, nil)
+			continue
+		}
+		if got, want := lf.String(), format; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	}
+}
+
+func TestCompileLogFormatInvalid(t *testing.T) {
+	tests := []struct {
+		format string
+		offset int
+		err    string
+	}{
+		{"{status} {bogus}", 9, "gohm: invalid log format at offset 9: unknown directive: {bogus}"},
+		{"a {} b", 2, "gohm: invalid log format at offset 2: unknown directive: {}"},
+		{"{status", 0, "gohm: invalid log format at offset 0: directive without close curly brace"},
+		{"{sta{tus}", 4, "gohm: invalid log format at offset 4: open curly brace inside directive"},
+		{"status} ", 6, "gohm: invalid log format at offset 6: close curly brace without matching open curly brace"},
+		{"{status} \\n", 9, "gohm: invalid log format at offset 9: invalid escape sequence: \\n"},
+		{"{status} \\", 9, "gohm: invalid log format at offset 9: backslash at end of format"},
+	}
+	for _, test := range tests {
+		lf, err := gohm.CompileLogFormat(test.format)
+		if lf != nil {
+			t.Errorf("%q: GOT: %v; WANT: %v", test.format, lf, nil)
+		}
+		var lfe *gohm.LogFormatError
+		if !errors.As(err, &lfe) {
+			t.Errorf("%q: GOT: %v; WANT: *gohm.LogFormatError", test.format, err)
+			continue
+		}
+		if got, want := lfe.Offset, test.offset; got != want {
+			t.Errorf("%q: GOT: %v; WANT: %v", test.format, got, want)
+		}
+		if got, want := err.Error(), test.err; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	}
+}
+
+func TestMustCompileLogFormatPanics(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("GOT: %v; WANT: panic", r)
+		}
+	}()
+	gohm.MustCompileLogFormat("{bogus}")
+}
+
+func TestLogWithCompiledLogFormat(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}), gohm.Config{
+		CompiledLogFormat: gohm.MustCompileLogFormat("{method} {uri} {status}"),
+		LogFormat:         "ignored",
+		LogWriter:         logOutput,
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	if got, want := logOutput.String(), "GET /some/url 202\n"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package gohm
+
+import (
+	"net/http"
+	"unicode/utf8"
+)
+
+// compileJSONFormat converts the parsed log line format into a slice of
+// functions to invoke when creating a JSON log line, and returns the names of
+// the request headers the format refers to.  Each directive in the format
+// becomes a field of a JSON object, named by the directive unless the specified
+// names map provides another name for it, while constant text in the format is
+// ignored.  When several directives would become fields with the same name,
+// only the first is emitted, so the object has no duplicate keys.  Times are
+// emitted as RFC 3339 strings, and directives that have no value, which are
+// emitted as "-" in text log lines, emit null.
+func compileJSONFormat(segments []logSegment, names map[string]string) ([]func(*responseWriter, *http.Request, *[]byte), []string) {
+	var emitters []func(*responseWriter, *http.Request, *[]byte)
+	hm := make(map[string]struct{})
+	keys := make(map[string]struct{})
+	delimiter := byte('{')
+
+	for _, segment := range segments {
+		tok := segment.directive // values are always escaped as JSON, so the modifier is ignored
+		if tok == "" {
+			continue
+		}
+		directive := tok
+		switch tok {
+		case "begin":
+			directive = "begin-iso8601"
+		case "end":
+			directive = "end-iso8601"
+		}
+		emitter, kind, header := directiveEmitter(directive)
+
+		name, ok := names[tok]
+		if !ok {
+			name = tok
+		}
+		if _, ok := keys[name]; ok {
+			continue
+		}
+		keys[name] = struct{}{}
+		if header != "" {
+			hm[header] = struct{}{}
+		}
+		prefix := appendJSONString([]byte{delimiter}, []byte(name))
+		prefix = append(prefix, ':')
+		delimiter = ','
+
+		emitters = append(emitters, makeJSONEmitter(string(prefix), emitter, kind))
+	}
+
+	if delimiter == '{' {
+		emitters = append(emitters, makeStringEmitter("{}\n"))
+	} else {
+		emitters = append(emitters, makeStringEmitter("}\n"))
+	}
+
+	return emitters, headerNames(hm)
+}
+
+// makeJSONEmitter returns an emitter that emits the specified prefix, followed
+// by the value emitted by the specified emitter, encoded as a JSON value of the
+// specified kind.  The value is emitted directly into the log line, then
+// encoded in place, so values that need no escaping are not copied.
+func makeJSONEmitter(prefix string, emitter func(*responseWriter, *http.Request, *[]byte), kind int) func(*responseWriter, *http.Request, *[]byte) {
+	return func(grw *responseWriter, r *http.Request, bb *[]byte) {
+		*bb = append(*bb, prefix...)
+		start := len(*bb)
+		emitter(grw, r, bb)
+		value := (*bb)[start:]
+
+		if len(value) == 0 {
+			// The directive has no value.
+			*bb = append((*bb)[:start], "null"...)
+			return
+		}
+		if kind == numberDirective || kind == boolDirective {
+			return
+		}
+		if !needsEscape(value) {
+			*bb = append(*bb, '"')
+			copy((*bb)[start+1:], (*bb)[start:len(*bb)-1])
+			(*bb)[start] = '"'
+			*bb = append(*bb, '"')
+			return
+		}
+		value = append([]byte(nil), value...) // copy, because it is escaped into the same buffer
+		*bb = appendJSONString((*bb)[:start], value)
+	}
+}
+
+// needsEscape returns true when the specified value contains a quotation mark,
+// backslash, control character, or byte that is not ASCII, any of which might
+// need to be escaped to be included in a JSON string or text log line.
+func needsEscape(value []byte) bool {
+	for _, b := range value {
+		if b < ' ' || b == '"' || b == '\\' || b == 0x7f || b >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends the specified value to buf as a quoted JSON string.
+func appendJSONString(buf, value []byte) []byte {
+	buf = append(buf, '"')
+	buf = appendJSONEscaped(buf, value)
+	return append(buf, '"')
+}
+
+// appendJSONEscaped appends the specified value to buf, escaped to be included
+// in a JSON string: quotation marks, backslashes, and control characters are
+// escaped, and invalid UTF-8 is replaced with the Unicode replacement
+// character.  Like encoding/json, it also escapes U+2028 and U+2029, so the
+// line may be embedded in JavaScript, and unlike encoding/json, it escapes
+// DEL and the C1 control characters, so they cannot reach a terminal.
+func appendJSONEscaped(buf, value []byte) []byte {
+	for i := 0; i < len(value); {
+		b := value[i]
+		if b < utf8.RuneSelf {
+			switch {
+			case b == '"' || b == '\\':
+				buf = append(buf, '\\', b)
+			case b == '\n':
+				buf = append(buf, '\\', 'n')
+			case b == '\r':
+				buf = append(buf, '\\', 'r')
+			case b == '\t':
+				buf = append(buf, '\\', 't')
+			case b < ' ' || b == 0x7f:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			default:
+				buf = append(buf, b)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(value[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			buf = append(buf, `\ufffd`...)
+		case isUnsafeRune(r):
+			buf = append(buf, '\\', 'u', hexDigits[r>>12], hexDigits[r>>8&0xF], hexDigits[r>>4&0xF], hexDigits[r&0xF])
+		default:
+			buf = append(buf, value[i:i+size]...)
+		}
+		i += size
+	}
+	return buf
+}
@@ -0,0 +1,155 @@
+package gohm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestLogJSON(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	request := httptest.NewRequest("GET", "/some/url?q=%22quoted%22", nil)
+	request.Header.Set("User-Agent", "evil\"agent\n\x01\xff\u2028")
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gohm.Annotate(r, "user", `C:\Users`)
+		w.Write([]byte("some body"))
+	}), gohm.Config{
+		LogFieldNames: map[string]string{"client-ip": "remote_addr", "http-User-Agent": "user_agent"},
+		LogFormat:     "{client-ip} [{begin}] \"{method} {uri}\" {status} {bytes} {duration} {timeout} {error} {field-user} {http-User-Agent} {bogus}",
+		LogJSON:       true,
+		LogWriter:     logOutput,
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	line := logOutput.Bytes()
+	if got, want := line[len(line)-1], byte('\n'); got != want {
+		t.Fatalf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := bytes.Count(line, []byte("\n")), 1; got != want {
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		t.Fatalf("%s: %q", err, line)
+	}
+
+	if got, want := len(fields), 11; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := fields["remote_addr"], "192.0.2.1"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := fields["uri"], "/some/url?q=%22quoted%22"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := fields["status"], float64(200); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := fields["bytes"], float64(9); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if _, ok := fields["duration"].(float64); !ok {
+		t.Errorf("GOT: %T; WANT: float64", fields["duration"])
+	}
+	if got := fields["timeout"]; got != nil {
+		t.Errorf("GOT: %v; WANT: %v", got, nil)
+	}
+	if got := fields["error"]; got != nil {
+		t.Errorf("GOT: %v; WANT: %v", got, nil)
+	}
+	if got, want := fields["field-user"], `C:\Users`; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := fields["user_agent"], "evil\"agent\n\x01\ufffd\u2028"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	begin, ok := fields["begin"].(string)
+	if !ok {
+		t.Fatalf("GOT: %T; WANT: string", fields["begin"])
+	}
+	if _, err := time.Parse(time.RFC3339, begin); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogJSONWithoutDirectives(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), gohm.Config{
+		LogFormat: "no directives",
+		LogJSON:   true,
+		LogWriter: logOutput,
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+
+	if got, want := logOutput.String(), "{}\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogJSONHyphenValues(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	request := httptest.NewRequest("GET", "/some/url", nil)
+	request.Header.Set("Referer", "-")
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gohm.SetMessage(r, "-")
+		gohm.Annotate(r, "user", "-")
+	}), gohm.Config{
+		LogFormat: "{message} {field-user} {referer} {user-agent}",
+		LogJSON:   true,
+		LogWriter: logOutput,
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	// Values that are a hyphen are strings, and only absent values are null.
+	if got, want := logOutput.String(), `{"message":"-","field-user":"-","referer":"-","user-agent":null}`+"\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestLogJSONDuplicateKeys(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), gohm.Config{
+		LogFieldNames: map[string]string{"method": "m", "proto": "m"},
+		LogFormat:     "{status} {method} {status|raw} {proto}",
+		LogJSON:       true,
+		LogWriter:     logOutput,
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+
+	if got, want := logOutput.String(), `{"status":200,"m":"GET"}`+"\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func BenchmarkWithJSONLogs(b *testing.B) {
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden) // error class forces log entry
+	}), gohm.Config{LogJSON: true, LogWriter: logOutput})
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		handler.ServeHTTP(recorder, request)
+		logOutput.Reset()
+	}
+}
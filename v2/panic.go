@@ -0,0 +1,86 @@
+package gohm
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// maxPanicFrames is the maximum number of stack frames included in the compact
+// stack trace emitted by the {panic-stack} log directive.
+const maxPanicFrames = 32
+
+// handlerPanic records a panic raised by the downstream handler.
+type handlerPanic struct {
+	value   interface{} // value is the value passed to panic
+	stack   []byte      // stack is the stack trace formatted by debug.Stack
+	compact string      // compact is the single line stack trace used for the log
+}
+
+// recoverHandlerPanic returns a handlerPanic for the specified value recovered
+// from a panic.  It must be called from the deferred function that recovered
+// the panic so the panicking goroutine's stack is still available.
+func recoverHandlerPanic(value interface{}) *handlerPanic {
+	pcs := make([]uintptr, maxPanicFrames)
+	n := runtime.Callers(3, pcs) // skip runtime.Callers, this function, and the deferred function
+	return &handlerPanic{
+		value:   value,
+		stack:   debug.Stack(),
+		compact: compactStack(pcs[:n]),
+	}
+}
+
+// compactStack formats the specified program counters as a single line, each
+// frame formatted as function(file:line), separated by semicolons.  Frames from
+// the runtime package, such as those which implement panic, are elided, as are
+// the import paths of the functions and the directories of the files.
+func compactStack(pcs []uintptr) string {
+	var buf []byte
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" && !strings.HasPrefix(frame.Function, "runtime.") {
+			if len(buf) > 0 {
+				buf = append(buf, ';')
+			}
+			function := frame.Function
+			if i := strings.LastIndexByte(function, '/'); i >= 0 {
+				function = function[i+1:]
+			}
+			file := frame.File
+			if i := strings.LastIndexByte(file, '/'); i >= 0 {
+				file = file[i+1:]
+			}
+			buf = append(buf, function...)
+			buf = append(buf, '(')
+			buf = append(buf, file...)
+			buf = append(buf, ':')
+			buf = strconv.AppendInt(buf, int64(frame.Line), 10)
+			buf = append(buf, ')')
+		}
+		if !more {
+			break
+		}
+	}
+	return string(buf)
+}
+
+// handlerPanicked responds to the client after the downstream handler panicked.
+// When the specified panic handler is not nil, it renders the response;
+// otherwise a 500 error with the panic value is sent.
+func (rw *responseWriter) handlerPanicked(r *http.Request, hp *handlerPanic, panicHandler func(http.ResponseWriter, *http.Request, interface{}, []byte)) {
+	text := fmt.Sprintf("%v", hp.value)
+	rw.panicValue = text
+	rw.panicStack = hp.compact
+
+	if rw.committed || panicHandler == nil {
+		rw.handlerError(text, http.StatusInternalServerError)
+		return
+	}
+	rw.handlerRespond(text, func(w http.ResponseWriter) {
+		panicHandler(w, r, hp.value, hp.stack)
+	})
+}
@@ -1,6 +1,7 @@
 package gohm_test
 
 import (
+	"bytes"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -94,3 +95,82 @@ func TestAllowPanicsTrue(t *testing.T) {
 		t.Errorf("GOT: %v; WANT: %v", got, want)
 	}
 }
+
+func TestPanicHandler(t *testing.T) {
+	const panicText = "secret internal detail"
+
+	logOutput := new(bytes.Buffer)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+
+	var panicValue interface{}
+	var panicStack []byte
+	var panicRequest *http.Request
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(panicText)
+	}), gohm.Config{
+		LogFormat: "{status} {panic} {panic-stack}",
+		LogWriter: logOutput,
+		PanicHandler: func(w http.ResponseWriter, r *http.Request, value interface{}, stack []byte) {
+			panicValue, panicStack, panicRequest = value, stack, r
+			gohm.Error(w, "", http.StatusInternalServerError)
+		},
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	resp := recorder.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := panicValue, interface{}(panicText); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := string(panicStack), "TestPanicHandler"; !strings.Contains(got, want) {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := panicRequest.URL.Path, "/some/url"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := resp.StatusCode, http.StatusInternalServerError; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := string(body), panicText; strings.Contains(got, want) {
+		t.Errorf("GOT: %v; WANT: not %v", got, want)
+	}
+
+	// Log line has status, panic value, and then a stack trace without spaces
+	// that begins with the function that panicked.
+	got := logOutput.String()
+	prefix := "500 " + panicText + " "
+	if !strings.HasPrefix(got, prefix) {
+		t.Fatalf("GOT: %q; WANT PREFIX: %q", got, prefix)
+	}
+	stack := strings.TrimSuffix(got[len(prefix):], "\n")
+	if strings.ContainsAny(stack, " \n") {
+		t.Errorf("GOT: %q; WANT: single field", stack)
+	}
+	if got, want := stack, "v2_test.TestPanicHandler.func1(panic_test.go:"; !strings.HasPrefix(got, want) {
+		t.Errorf("GOT: %q; WANT PREFIX: %q", got, want)
+	}
+}
+
+func TestPanicDirectivesWithoutPanic(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), gohm.Config{
+		LogFormat: "{panic} {panic-stack}",
+		LogWriter: logOutput,
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	if got, want := logOutput.String(), "- -\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+package gohm
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitMaxClients is the number of client token buckets a
+// RateLimitHandler keeps when RateLimitConfig.MaxClients is 0.
+const DefaultRateLimitMaxClients = 10000
+
+// DefaultRateLimitNewKeyBurst is the number of buckets for new Header values
+// requests from one client IP address may create at once, when
+// RateLimitConfig.NewKeyBurst is 0.
+const DefaultRateLimitNewKeyBurst = 10
+
+// RateLimitConfig holds parameters for configuring a RateLimitHandler.
+type RateLimitConfig struct {
+	// Burst is the number of tokens each client's bucket holds when full,
+	// which is the number of requests a client may send at once after being
+	// idle.  It is also sent in the "RateLimit-Limit" response header.  When
+	// less than 1, the bucket holds 1 token.
+	Burst int
+
+	// Header, when not empty, names a request header whose value identifies
+	// the client, such as "X-API-Key", so clients that share an IP address
+	// have their own buckets.  Because gohm cannot verify the value, the
+	// number of buckets requests from one client IP address may create for
+	// values not seen before is limited by NewKeyBurst and NewKeyRate.
+	// Requests without the header are keyed by client IP address.
+	Header string
+
+	// Key, when not nil, is called to obtain the key that identifies the
+	// client of each request, and takes precedence over Header.  Unlike
+	// Header, the number of keys requests from one client IP address may
+	// create is not limited, so Key must return an identity the server has
+	// verified, such as the API key of an authenticated client, rather than a
+	// value a client may choose freely.  When it returns the empty string, the
+	// request is keyed by Header or client IP address.
+	Key func(*http.Request) string
+
+	// MaxClients is the maximum number of client token buckets kept in
+	// memory.  When a request arrives from a new client and the limit has been
+	// reached, the bucket of the client that has been idle the longest is
+	// discarded.  When 0, DefaultRateLimitMaxClients is used.
+	MaxClients int
+
+	// NewKeyBurst is the number of buckets for Header values not seen before
+	// that requests from one client IP address may create at once.  Without
+	// it, a client could evade its limit by sending a different value with
+	// each request, and fill MaxClients with buckets, evicting those of other
+	// clients.  When less than 1, DefaultRateLimitNewKeyBurst is used.
+	NewKeyBurst int
+
+	// NewKeyRate is the number of buckets per second for Header values not
+	// seen before that requests from one client IP address may create after
+	// NewKeyBurst buckets have been created.  When 0, Rate is used.
+	NewKeyRate float64
+
+	// Rate is the number of tokens per second added to each client's bucket,
+	// which is the sustained number of requests per second a client may send.
+	// When 0, buckets are never refilled, and each client may send only Burst
+	// requests.
+	Rate float64
+}
+
+// RateLimitHandler returns a handler that limits the rate of requests from each
+// client using a token bucket per client.  Clients are identified by the client
+// IP address, the same value emitted by the {client-ip} log directive, unless
+// RateLimitConfig specifies a request header or key function.  Each request
+// takes one token from its client's bucket, and requests that find the bucket
+// empty, or that would create a bucket for a new header value when their client
+// IP address may create no more, receive a 429 Too Many Requests response from
+// gohm.Error with a "Retry-After" header.  All responses include
+// "RateLimit-Limit", "RateLimit-Remaining", and "RateLimit-Reset" headers
+// describing the client's bucket.
+//
+//	mux := http.NewServeMux()
+//	mux.Handle("/example/path", gohm.New(gohm.RateLimitHandler(gohm.RateLimitConfig{
+//		Burst: 20,
+//		Rate:  5,
+//	}, someHandler), gohm.Config{}))
+func RateLimitHandler(config RateLimitConfig, next http.Handler) http.Handler {
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	if config.MaxClients <= 0 {
+		config.MaxClients = DefaultRateLimitMaxClients
+	}
+	if config.Rate < 0 {
+		config.Rate = 0
+	}
+	if config.Header != "" {
+		config.Header = http.CanonicalHeaderKey(config.Header)
+	}
+	if config.NewKeyBurst < 1 {
+		config.NewKeyBurst = DefaultRateLimitNewKeyBurst
+	}
+	if config.NewKeyRate <= 0 {
+		config.NewKeyRate = config.Rate
+	}
+
+	rl := newRateLimiter(config.Burst, config.Rate, config.MaxClients)
+	newKeys := newRateLimiter(config.NewKeyBurst, config.NewKeyRate, config.MaxClients) // keyed by client IP address
+	limit := strconv.Itoa(config.Burst)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		var key string
+		var create func() bool
+		if config.Key != nil {
+			key = config.Key(r)
+		}
+		if key == "" && config.Header != "" {
+			if value := r.Header.Get(config.Header); value != "" {
+				// Prefix header values with the header name, which cannot be
+				// confused with an IP address, so a client cannot deplete the
+				// bucket of another client by sending its IP address.
+				key = config.Header + ":" + value
+				// Only creating a bucket for a value not seen before is
+				// charged to the client IP address, so clients sharing an IP
+				// address do not share their budget.
+				ip := clientIP(r.RemoteAddr)
+				create = func() bool {
+					ok, _ := newKeys.take(ip, now, nil)
+					return ok
+				}
+			}
+		}
+		if key == "" {
+			key = clientIP(r.RemoteAddr)
+		}
+
+		ok, tokens := rl.take(key, now, create)
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", limit)
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		if rl.rate > 0 {
+			h.Set("RateLimit-Reset", secondsUntil(rl.burst-tokens, rl.rate))
+		}
+
+		if !ok {
+			if rl.rate > 0 {
+				h.Set("Retry-After", secondsUntil(1-tokens, rl.rate))
+			}
+			Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter holds the token buckets of the most recently active clients.
+type rateLimiter struct {
+	lock       sync.Mutex
+	buckets    map[string]*list.Element // buckets values are *tokenBucket
+	idle       *list.List               // idle orders buckets from most to least recently used
+	burst      float64
+	rate       float64
+	maxClients int
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time // last is when tokens was last updated
+}
+
+// newRateLimiter returns a rateLimiter whose buckets hold the specified burst
+// of tokens, and are refilled at the specified rate.
+func newRateLimiter(burst int, rate float64, maxClients int) *rateLimiter {
+	return &rateLimiter{
+		buckets:    make(map[string]*list.Element),
+		idle:       list.New(),
+		burst:      float64(burst),
+		rate:       rate,
+		maxClients: maxClients,
+	}
+}
+
+// take refills the bucket for the specified client key, then attempts to take
+// a token from it.  When the client has no bucket, and create is not nil,
+// create is called to decide whether a bucket may be created for it.  It
+// returns true when a token was taken, along with the number of tokens
+// remaining in the bucket.
+func (rl *rateLimiter) take(key string, now time.Time, create func() bool) (bool, float64) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	var tb *tokenBucket
+	if e, ok := rl.buckets[key]; ok {
+		rl.idle.MoveToFront(e)
+		tb = e.Value.(*tokenBucket)
+		tb.tokens = math.Min(rl.burst, tb.tokens+now.Sub(tb.last).Seconds()*rl.rate)
+		tb.last = now
+	} else {
+		if create != nil && !create() {
+			return false, 0
+		}
+		if rl.idle.Len() >= rl.maxClients {
+			// Evict the client that has been idle the longest.  Should it
+			// return, it starts with a full bucket.
+			oldest := rl.idle.Back()
+			rl.idle.Remove(oldest)
+			delete(rl.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		tb = &tokenBucket{key: key, tokens: rl.burst, last: now}
+		rl.buckets[key] = rl.idle.PushFront(tb)
+	}
+
+	if tb.tokens < 1 {
+		return false, tb.tokens
+	}
+	tb.tokens--
+	return true, tb.tokens
+}
+
+// secondsUntil returns the number of whole seconds, rounded up, until the
+// specified number of tokens are added to a bucket refilled at the specified
+// rate.
+func secondsUntil(tokens, rate float64) string {
+	return strconv.FormatFloat(math.Ceil(tokens/rate), 'f', 0, 64)
+}
+
+// clientIP returns the IP address portion of the specified remote address,
+// which is either "ipv4:port" or "[ipv6]:port".
+func clientIP(remoteAddr string) string {
+	value := remoteAddr
+	// strip port
+	if colon := strings.LastIndexByte(value, ':'); colon != -1 {
+		value = value[:colon]
+	}
+	// strip square brackets
+	if l := len(value); l > 2 && value[0] == '[' && value[l-1] == ']' {
+		value = value[1 : l-1]
+	}
+	return value
+}
@@ -0,0 +1,140 @@
+package gohm_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestRateLimitHandler(t *testing.T) {
+	okHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func(handler http.Handler, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		request.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			request.Header.Set("X-API-Key", apiKey)
+		}
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("keyed by client ip", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		handler := gohm.New(gohm.RateLimitHandler(gohm.RateLimitConfig{Burst: 2, Rate: 0.5}, okHandler), gohm.Config{
+			LogFormat: "{client-ip} {status}",
+			LogWriter: logOutput,
+		})
+
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			recorder := serve(handler, "[2001:db8::1]:1234", "")
+			if got := recorder.Code; got != want {
+				t.Errorf("request %d: GOT: %v; WANT: %v", i, got, want)
+			}
+		}
+
+		recorder := serve(handler, "[2001:db8::1]:5678", "")
+		if got, want := recorder.Code, http.StatusTooManyRequests; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := recorder.Header().Get("Retry-After"), "2"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := recorder.Header().Get("RateLimit-Limit"), "2"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := recorder.Header().Get("RateLimit-Remaining"), "0"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := recorder.Header().Get("RateLimit-Reset"), "4"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		// Different client has its own bucket.
+		if got, want := serve(handler, "192.0.2.1:1234", "").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		if got, want := logOutput.String(), "2001:db8::1 200\n2001:db8::1 200\n2001:db8::1 429\n2001:db8::1 429\n192.0.2.1 200\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("keyed by header", func(t *testing.T) {
+		handler := gohm.RateLimitHandler(gohm.RateLimitConfig{Burst: 1, Header: "X-API-Key", Rate: 1}, okHandler)
+
+		if got, want := serve(handler, "192.0.2.1:1234", "alpha").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := serve(handler, "192.0.2.1:1234", "alpha").Code, http.StatusTooManyRequests; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		// Same client IP, different key.
+		if got, want := serve(handler, "192.0.2.1:1234", "bravo").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		// Different client IP, same key.
+		if got, want := serve(handler, "192.0.2.2:1234", "alpha").Code, http.StatusTooManyRequests; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		// Without the header, keyed by client IP.
+		if got, want := serve(handler, "192.0.2.1:1234", "").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("new header values limited by client ip", func(t *testing.T) {
+		handler := gohm.RateLimitHandler(gohm.RateLimitConfig{Burst: 2, Header: "X-API-Key", MaxClients: 4, NewKeyBurst: 2}, okHandler)
+
+		if got, want := serve(handler, "192.0.2.9:1234", "").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		// A client sending a different value with each request cannot create
+		// more buckets than its IP address is permitted.
+		var allowed int
+		for i := 0; i < 10; i++ {
+			if serve(handler, "192.0.2.1:1234", "key-"+strconv.Itoa(i)).Code == http.StatusOK {
+				allowed++
+			}
+		}
+		if got, want := allowed, 2; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		// Values already seen are not limited by the client IP address.
+		if got, want := serve(handler, "192.0.2.1:1234", "key-0").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		// Nor can it evict the bucket of another client, which would then
+		// return with a full bucket.
+		if got, want := serve(handler, "192.0.2.9:1234", "").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := serve(handler, "192.0.2.9:1234", "").Code, http.StatusTooManyRequests; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("evicts least recently used client", func(t *testing.T) {
+		handler := gohm.RateLimitHandler(gohm.RateLimitConfig{Burst: 1, MaxClients: 2, Rate: 1}, okHandler)
+
+		serve(handler, "192.0.2.1:1234", "")
+		serve(handler, "192.0.2.2:1234", "")
+		serve(handler, "192.0.2.1:1234", "") // 192.0.2.2 now least recently used
+		serve(handler, "192.0.2.3:1234", "") // evicts 192.0.2.2
+
+		if got, want := serve(handler, "192.0.2.1:1234", "").Code, http.StatusTooManyRequests; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := serve(handler, "192.0.2.2:1234", "").Code, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
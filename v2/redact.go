@@ -0,0 +1,185 @@
+package gohm
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultRedactionMask replaces redacted values when Redaction.Mask is empty.
+const DefaultRedactionMask = "REDACTED"
+
+// Redaction specifies which values are masked in log lines, in the Statistics
+// passed to Config.Callback, and in requests dumped by WithRedactedRequestDumper,
+// so secrets such as credentials and tokens are not recorded.
+//
+//	redaction := &gohm.Redaction{
+//		Headers:         []string{"Authorization", "Cookie", "Set-Cookie"},
+//		QueryParameters: []string{"access_token", "api_key"},
+//		Patterns:        []*regexp.Regexp{regexp.MustCompile(`sk_live_[0-9A-Za-z]+`)},
+//	}
+type Redaction struct {
+	// Headers lists the names of the request and response headers whose
+	// values are masked.  Names are matched without regard to case.
+	Headers []string
+
+	// Mask replaces each redacted value.  When empty, DefaultRedactionMask is
+	// used.
+	Mask string
+
+	// Patterns lists regular expressions whose matches are masked wherever
+	// they appear in request URIs, paths, query strings, header values, and
+	// request and response bodies, as well as in messages and fields set by
+	// SetMessage and Annotate.
+	Patterns []*regexp.Regexp
+
+	// QueryParameters lists the names of the query parameters whose values are
+	// masked, in the request URI as well as in the URI of the Referer header.
+	// Names are matched exactly, after being unescaped.
+	QueryParameters []string
+}
+
+func (rd *Redaction) mask() string {
+	if rd.Mask == "" {
+		return DefaultRedactionMask
+	}
+	return rd.Mask
+}
+
+// redactsHeader returns true when the value of the specified header is masked.
+func (rd *Redaction) redactsHeader(name string) bool {
+	for _, header := range rd.Headers {
+		if strings.EqualFold(header, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactsQueryParameter returns true when the value of the specified query
+// parameter is masked.
+func (rd *Redaction) redactsQueryParameter(name string) bool {
+	for _, parameter := range rd.QueryParameters {
+		if parameter == name {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue returns the specified value with the matches of all Patterns
+// masked.  Like the other redact methods, it may be called with a nil
+// receiver, in which case it returns the value unchanged.
+func (rd *Redaction) redactValue(value string) string {
+	if rd == nil {
+		return value
+	}
+	for _, re := range rd.Patterns {
+		value = re.ReplaceAllLiteralString(value, rd.mask())
+	}
+	return value
+}
+
+// redactBody returns the specified body, or a copy with the matches of all
+// Patterns masked.  The specified body is never modified, because it may be
+// the buffer of a request or response.
+func (rd *Redaction) redactBody(body []byte) []byte {
+	if rd == nil || len(body) == 0 {
+		return body
+	}
+	for _, re := range rd.Patterns {
+		body = re.ReplaceAllLiteral(body, []byte(rd.mask()))
+	}
+	return body
+}
+
+// redactHeader returns the specified value of the specified header, masked
+// entirely when the header is listed in Headers, or with the matches of all
+// Patterns masked otherwise.  The Referer header holds the URI of the page
+// that linked to the request, so its query string is redacted like
+// redactQuery.
+func (rd *Redaction) redactHeader(name, value string) string {
+	if rd == nil {
+		return value
+	}
+	if rd.redactsHeader(name) {
+		return rd.mask()
+	}
+	if strings.EqualFold(name, "Referer") {
+		return rd.redactURI(value)
+	}
+	return rd.redactValue(value)
+}
+
+// redactHeaders returns the specified headers, or a copy with their values
+// redacted like redactHeader.
+func (rd *Redaction) redactHeaders(headers http.Header) http.Header {
+	if rd == nil || len(headers) == 0 || len(rd.Headers) == 0 && len(rd.Patterns) == 0 && len(rd.QueryParameters) == 0 {
+		return headers
+	}
+	redacted := make(http.Header, len(headers))
+	for name, values := range headers {
+		rv := make([]string, len(values))
+		for i, value := range values {
+			rv[i] = rd.redactHeader(name, value)
+		}
+		redacted[name] = rv
+	}
+	return redacted
+}
+
+// redactQuery returns the specified raw query string, with the values of the
+// query parameters listed in QueryParameters masked, and the matches of all
+// Patterns masked.  The order and encoding of the query parameters are
+// otherwise preserved.
+func (rd *Redaction) redactQuery(rawQuery string) string {
+	if rd == nil || rawQuery == "" {
+		return rawQuery
+	}
+	if len(rd.QueryParameters) > 0 {
+		parameters := strings.Split(rawQuery, "&")
+		var changed bool
+		for i, parameter := range parameters {
+			key, _, ok := strings.Cut(parameter, "=")
+			if !ok {
+				continue
+			}
+			name := key
+			if unescaped, err := url.QueryUnescape(key); err == nil {
+				name = unescaped
+			}
+			if rd.redactsQueryParameter(name) {
+				parameters[i] = key + "=" + rd.mask()
+				changed = true
+			}
+		}
+		if changed {
+			rawQuery = strings.Join(parameters, "&")
+		}
+	}
+	return rd.redactValue(rawQuery)
+}
+
+// redactURI returns the specified request URI, with its query string redacted
+// like redactQuery, and the matches of all Patterns masked in its path.
+func (rd *Redaction) redactURI(uri string) string {
+	if rd == nil {
+		return uri
+	}
+	if path, query, ok := strings.Cut(uri, "?"); ok {
+		return rd.redactValue(path) + "?" + rd.redactQuery(query)
+	}
+	return rd.redactValue(uri)
+}
+
+// redactURL redacts the path and query string of the specified URL, which must
+// be a copy, in place.
+func (rd *Redaction) redactURL(u *url.URL) {
+	if rd == nil || u == nil {
+		return
+	}
+	u.Path = rd.redactValue(u.Path)
+	u.RawPath = rd.redactValue(u.RawPath)
+	u.RawQuery = rd.redactQuery(u.RawQuery)
+}
@@ -0,0 +1,174 @@
+package gohm_test
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func testRedaction() *gohm.Redaction {
+	return &gohm.Redaction{
+		Headers:         []string{"authorization", "Cookie", "Set-Cookie"},
+		QueryParameters: []string{"access_token", "api key"},
+		Patterns:        []*regexp.Regexp{regexp.MustCompile(`sk_[0-9a-z]+`)},
+	}
+}
+
+func redactedRequest() *http.Request {
+	request := httptest.NewRequest("GET", "/reset/sk_path?a=1&access_token=secret&api+key=secret&b=sk_query", strings.NewReader("body sk_body"))
+	request.Header.Set("Authorization", "Basic YWxpY2U6c2VjcmV0") // alice:secret
+	request.Header.Set("Cookie", "session=secret")
+	request.Header.Set("Referer", "https://example.com/sk_page?access_token=secret&b=1")
+	request.Header.Set("User-Agent", "agent sk_agent")
+	return request
+}
+
+func TestRedactionLog(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gohm.SetMessage(r, "message sk_message")
+		gohm.Annotate(r, "key", "sk_field")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+	}), gohm.Config{
+		LogFormat: "{request-line}|{path}|{query}|{http-Authorization}|{http-Cookie}|{referer}|{user-agent}|{http-Missing}|{remote-user}|{resp-http-Set-Cookie}|{resp-http-Content-Type}|{message}|{field-key}",
+		LogWriter: logOutput,
+		Redaction: testRedaction(),
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), redactedRequest())
+
+	got := logOutput.String()
+	want := "GET /reset/REDACTED?a=1&access_token=REDACTED&api+key=REDACTED&b=REDACTED HTTP/1.1|/reset/REDACTED|a=1&access_token=REDACTED&api+key=REDACTED&b=REDACTED|REDACTED|REDACTED|https://example.com/REDACTED?access_token=REDACTED&b=1|agent REDACTED|-|alice|REDACTED|text/plain|message REDACTED|REDACTED\n"
+	if got != want {
+		t.Errorf("\nGOT:  %q\nWANT: %q", got, want)
+	}
+}
+
+func TestRedactionJSONLog(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), gohm.Config{
+		LogFormat: "{uri} {http-Cookie}",
+		LogJSON:   true,
+		LogWriter: logOutput,
+		Redaction: &gohm.Redaction{Headers: []string{"Cookie"}, QueryParameters: []string{"access_token"}, Mask: "***"},
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), redactedRequest())
+
+	if got, want := logOutput.String(), `{"uri":"/reset/sk_path?a=1&access_token=***&api+key=secret&b=sk_query","http-Cookie":"***"}`+"\n"; got != want {
+		t.Errorf("\nGOT:  %v\nWANT: %v", got, want)
+	}
+}
+
+func TestRedactionStatistics(t *testing.T) {
+	var stats *gohm.Statistics
+	var handlerBody, handlerQuery, requestBody, responseBody, handlerSetCookie string
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gohm.SetMessage(r, "message sk_message")
+		gohm.Annotate(r, "key", "sk_field")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("response sk_response"))
+		buf, _ := io.ReadAll(r.Body)
+		handlerBody = string(buf)
+		handlerQuery = r.URL.Query().Get("access_token")
+	}), gohm.Config{
+		Callback: func(s *gohm.Statistics) {
+			stats = s
+			// Bodies and headers are only valid until the callback returns.
+			handlerSetCookie = s.ResponseHeader.Get("Set-Cookie")
+			requestBody = string(s.RequestBody)
+			responseBody = string(s.ResponseBody)
+		},
+		EscrowReader: true,
+		Redaction:    testRedaction(),
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, redactedRequest())
+
+	// The downstream handler and client see the values that are redacted.
+	if got, want := handlerQuery, "secret"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := handlerBody, "body sk_body"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := recorder.Header().Get("Set-Cookie"), "session=secret"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := recorder.Body.String(), "response sk_response"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	if got, want := stats.RequestURL.String(), "/reset/REDACTED?a=1&access_token=REDACTED&api+key=REDACTED&b=REDACTED"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := handlerSetCookie, "REDACTED"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := requestBody, "body REDACTED"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := responseBody, "response REDACTED"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := stats.Message, "message REDACTED"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := stats.Fields["key"], "REDACTED"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestWithRedactedRequestDumper(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+	previous := log.Writer()
+	log.SetOutput(logOutput)
+	defer log.SetOutput(previous)
+
+	var handlerBody, handlerAuthorization string
+	flag := uint32(2)
+
+	handler := gohm.WithRedactedRequestDumper(&flag, testRedaction(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		handlerBody = string(buf)
+		handlerAuthorization = r.Header.Get("Authorization")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), redactedRequest())
+
+	// The downstream handler receives the request that is redacted.
+	if got, want := handlerBody, "body sk_body"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := handlerAuthorization, "Basic YWxpY2U6c2VjcmV0"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	dump := logOutput.String()
+	for _, secret := range []string{"secret", "sk_", "YWxpY2U6c2VjcmV0"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("GOT: %q; WANT: no %q", dump, secret)
+		}
+	}
+	for _, want := range []string{"GET /reset/REDACTED?a=1&access_token=REDACTED", "Authorization: REDACTED", "Cookie: REDACTED", "Referer: https://example.com/REDACTED?access_token=REDACTED&b=1", "body REDACTED"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("GOT: %q; WANT: %q", dump, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package gohm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// contextKey is the type of keys gohm uses to store values in request
+// contexts, so they cannot collide with keys from other packages.
+type contextKey int
+
+const (
+	requestIDKey      contextKey = iota
+	responseWriterKey            // responseWriterKey allows SetMessage and Annotate to find the responseWriter
+)
+
+// maxRequestIDLength is the maximum length of a request ID accepted from a
+// client.  Longer IDs are replaced with a generated ID.
+const maxRequestIDLength = 128
+
+// RequestID returns the ID of the request having the specified context, or the
+// empty string when gohm.New is not configured with Config.RequestIDHeader.
+// Handlers may include it in their own log messages, or forward it to
+// downstream services, to correlate them with gohm's log line.
+//
+//	func someHandler(w http.ResponseWriter, r *http.Request) {
+//		log.Printf("[%s] something happened", gohm.RequestID(r.Context()))
+//		// ...
+//	}
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestIDFallback is used to generate unique request IDs in the unlikely
+// event the system random number generator fails.
+var requestIDFallback uint64
+
+// newRequestID returns a random 128-bit request ID formatted as 32 hexadecimal
+// digits.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&requestIDFallback, 1), 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID returns true when the specified request ID received from a
+// client is not empty, not too long, and only has printable ASCII characters
+// other than space, so it is safe to echo in a response header and to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package gohm_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestRequestID(t *testing.T) {
+	serve := func(requestID string) (string, string, string, *httptest.ResponseRecorder) {
+		logOutput := new(bytes.Buffer)
+		var handlerID, forwardedID string
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerID = gohm.RequestID(r.Context())
+			forwardedID = r.Header.Get("X-Request-ID")
+		}), gohm.Config{
+			LogFormat:       "{request-id} {http-X-Request-ID} {status}",
+			LogWriter:       logOutput,
+			RequestIDHeader: "X-Request-ID",
+		})
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		if requestID != "" {
+			request.Header.Set("X-Request-ID", requestID)
+		}
+		handler.ServeHTTP(recorder, request)
+		return handlerID, forwardedID, logOutput.String(), recorder
+	}
+
+	t.Run("accepts client id", func(t *testing.T) {
+		handlerID, forwardedID, logLine, recorder := serve("abc-123")
+
+		if got, want := handlerID, "abc-123"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := forwardedID, "abc-123"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := recorder.Header().Get("X-Request-ID"), "abc-123"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := logLine, "abc-123 abc-123 200\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	for name, requestID := range map[string]string{
+		"generates when missing": "",
+		"replaces invalid id":    "has spaces\tand tabs",
+		"replaces long id":       strings.Repeat("x", 129),
+	} {
+		t.Run(name, func(t *testing.T) {
+			handlerID, forwardedID, logLine, recorder := serve(requestID)
+
+			if got, want := len(handlerID), 32; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+			if got, want := forwardedID, handlerID; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+			if got, want := recorder.Header().Get("X-Request-ID"), handlerID; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+			// The generated ID is logged for the request header too.
+			if got, want := logLine, handlerID+" "+handlerID+" 200\n"; got != want {
+				t.Errorf("GOT: %q; WANT: %q", got, want)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		var handlerID string
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerID = gohm.RequestID(r.Context())
+		}), gohm.Config{
+			LogFormat: "{request-id} {status}",
+			LogWriter: logOutput,
+		})
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/some/url", nil))
+
+		if got, want := handlerID, ""; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := recorder.Header().Get("X-Request-ID"), ""; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := logOutput.String(), "- 200\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+}
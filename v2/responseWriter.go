@@ -2,43 +2,156 @@ package gohm
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ErrResponseTooLarge is returned by the http.ResponseWriter given to the
+// downstream handler when it attempts to write a response body larger than
+// Config.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("gohm: response body too large")
+
 // responseWriter must behave exactly like http.ResponseWriter, yet store up
-// response until query complete.
+// response until query complete, unless streaming, in which case it passes the
+// response through to the client as it is written.
 //
 // Only need locks on Header, Write, and WriteHeader, so if this is in the
 // middle of dealing with a handler timeout, and the handler invokes one of
 // these methods, we prevent race case.
 type responseWriter struct {
 	// size 24
-	begin, end time.Time // begin and end track the duration of the request for logging purposes
+	begin, end            time.Time // begin and end track the duration of the request for logging purposes
+	loggedResponseHeaders []string  // loggedResponseHeaders are the names of the response headers the log format refers to
 
 	// size 16
-	requestHeaders  map[string]string
-	responseError   string
-	responseMessage atomic.Value // string
-	responseWriter  http.ResponseWriter
+	panicStack        string // panicStack is the compact stack trace when downstream handler panicked
+	panicValue        string // panicValue is the formatted value when downstream handler panicked
+	requestHeaders    map[string]string
+	requestHost       string // requestHost, requestPath, and requestQuery are copied before the handler may modify the request
+	requestMethod     string // requestMethod, requestProto, requestRemoteAddr, and requestURI are copied for the same reason
+	requestPath       string
+	requestProto      string
+	requestQuery      string
+	requestRemoteAddr string
+	requestTooLarge   string // requestTooLarge is the error sent when the downstream handler read past Config.MaxRequestBytes
+	requestID         string // requestID is the ID of the request when Config.RequestIDHeader is set
+	requestURI        string
+	responseError     string
+	responseMessage   atomic.Value // string
+	responseWriter    http.ResponseWriter
 
 	// size 8
-	bytesWritten    int64
-	responseBody    *bytes.Buffer
-	responseHeaders http.Header
-	responseStatus  int
+	bytesRead        int64
+	bytesWritten     int64
+	requestBody      *countingReadCloser // requestBody, when not nil, counts bytes read from the request body
+	requestDone      <-chan struct{}     // requestDone is closed when the request context, without gohm's timeout, is done
+	fields           map[string]string   // fields holds values set by Annotate, and is guarded by fieldsLock
+	sentHeaders      map[string]string   // sentHeaders holds the values of loggedResponseHeaders copied when gohm sent the response
+	hijacked         *hijackedConn       // hijacked is not nil after downstream handler hijacks the connection
+	redaction        *Redaction          // redaction, when not nil, masks secrets in logged values
+	maxResponseBytes int64               // maxResponseBytes, when not 0, limits size of buffered response body
+	responseBody     *bytes.Buffer
+	responseHeaders  http.Header
+	responseStatus   int
+	sampleRate       uint32          // sampleRate is the log sampling rate applied to the request, in parts per million
+	timeout          time.Duration   // timeout is the effective timeout for the request, or 0 when none
+	timeoutContext   *timeoutContext // timeoutContext, when not nil, enforces the timeout, which is stopped when the connection is hijacked
+	tooLargeStatus   int             // tooLargeStatus is the status code sent when response body exceeds maxResponseBytes
 
 	// size 4 or 8
-	lock sync.Mutex
+	lock       sync.Mutex
+	fieldsLock sync.Mutex // fieldsLock is distinct from lock, which is held while Config.TimeoutHandler runs
+	writeLock  sync.Mutex // writeLock serializes streaming writes to the client, which are not made while holding lock; acquire before lock
+
+	// size 4
+	handlerState int32 // handlerState is accessed atomically, and tracks whether handler was abandoned
 
 	// size 1
-	timedOut    bool
-	wroteHeader bool
+	aborted      bool // aborted is set when the connection must be aborted rather than answered
+	committed    bool // committed is set once status and headers have been sent to the client
+	disconnected bool // disconnected is set when client disconnected before the response was sent
+	sampled      bool // sampled is set when the request was selected to be logged by status class and sampling
+	streaming    bool // streaming causes writes to pass through to the client rather than be buffered
+	timedOut     bool
+	tooLarge     bool // tooLarge is set when downstream handler attempted to write more than maxResponseBytes
+	tooLargeSent bool // tooLargeSent is set when the error response for tooLarge was sent in place of the buffered response
+	wroteHeader  bool
+}
+
+// commit sends the response status and headers to the underlying
+// http.ResponseWriter.  After this is called, neither the status nor the
+// headers may be changed.  Only used when streaming.
+func (rw *responseWriter) commit() {
+	if rw.responseHeaders != nil {
+		responseHeaders := rw.responseWriter.Header()
+		for k, vv := range rw.responseHeaders {
+			responseHeaders[k] = vv
+		}
+	}
+	rw.responseWriter.WriteHeader(rw.responseStatus)
+	rw.committed = true
+	rw.copyResponseHeaders()
+}
+
+// copyResponseHeaders copies the values of the response headers the log format
+// refers to from the underlying http.ResponseWriter, after gohm sent them to the
+// client.  Like request headers, they must be copied, because the request may
+// be logged after the server no longer permits the http.ResponseWriter to be
+// used, such as when an abandoned handler returns.
+func (rw *responseWriter) copyResponseHeaders() {
+	if len(rw.loggedResponseHeaders) == 0 {
+		return
+	}
+	responseHeaders := rw.responseWriter.Header()
+	rw.sentHeaders = make(map[string]string, len(rw.loggedResponseHeaders))
+	for _, name := range rw.loggedResponseHeaders {
+		rw.sentHeaders[name] = responseHeaders.Get(name) // NOTE: only saves first value, because that is all that is logged.
+	}
 }
 
 func (rw *responseWriter) handlerComplete() {
+	if rw.hijacked != nil {
+		rw.hijackComplete()
+		return
+	}
+
+	if rw.requestTooLarge != "" && !rw.streaming && rw.requestBody != nil && rw.requestBody.limitReached() {
+		// The downstream handler read the request body up to the limit, and
+		// whatever it responded, the client ought to learn its request was
+		// too large, just as when it is rejected before the handler runs.
+		error := rw.requestTooLarge
+		rw.handlerRespond(error, func(w http.ResponseWriter) {
+			Error(w, error, http.StatusRequestEntityTooLarge)
+		})
+		return
+	}
+
+	if rw.tooLarge {
+		// The buffered response is incomplete because the downstream handler
+		// attempted to write more than permitted, so it must not be sent.
+		rw.handlerError("response body exceeds "+strconv.FormatInt(rw.maxResponseBytes, 10)+" bytes", rw.tooLargeStatus)
+		rw.tooLargeSent = true
+		return
+	}
+
+	if rw.streaming {
+		// Body has already been sent to the client as it was written, but the
+		// handler may have returned without writing anything at all.
+		if !rw.wroteHeader {
+			rw.writeHeader(http.StatusOK)
+		}
+		if !rw.committed {
+			rw.commit()
+		}
+		rw.end = time.Now()
+		return
+	}
+
 	if rw.responseHeaders != nil {
 		responseHeaders := rw.responseWriter.Header()
 		for k, vv := range rw.responseHeaders {
@@ -50,6 +163,7 @@ func (rw *responseWriter) handlerComplete() {
 		rw.writeHeader(http.StatusOK)
 	}
 	rw.responseWriter.WriteHeader(rw.responseStatus)
+	rw.copyResponseHeaders()
 
 	n, err := rw.responseWriter.Write(rw.responseBody.Bytes()) // buffer.WriteTo would Reset after dumping its contents, but that is not needed
 	if err != nil {
@@ -57,7 +171,11 @@ func (rw *responseWriter) handlerComplete() {
 		// underlying http.ResponseWriter.  NOTE: This does not change what was
 		// actually written to the client, because that has already failed.
 		rw.responseError = err.Error()
-		rw.responseStatus = http.StatusInternalServerError
+		if err != http.ErrBodyNotAllowed {
+			// When the status code does not permit a body, such as 1xx, 204,
+			// and 304, the status was still successfully sent to the client.
+			rw.responseStatus = http.StatusInternalServerError
+		}
 	}
 
 	// for access log
@@ -66,8 +184,25 @@ func (rw *responseWriter) handlerComplete() {
 }
 
 func (rw *responseWriter) handlerError(error string, status int) {
+	if rw.committed {
+		// Status and headers have already been sent to the client, and perhaps
+		// some of the body as well, so it is too late to send an error
+		// response.  Record the error for the log, and mark the connection to
+		// be aborted so the client can detect the response is incomplete.
+		rw.aborted = true
+		rw.end = time.Now()
+		rw.responseError = error
+		if rw.hijacked != nil {
+			_ = rw.hijacked.Close()
+			rw.bytesRead = atomic.LoadInt64(&rw.hijacked.bytesRead)
+			rw.bytesWritten = atomic.LoadInt64(&rw.hijacked.bytesWritten)
+		}
+		return
+	}
+
 	// Defer to standard library when there was a handler error.
 	http.Error(rw.responseWriter, error, status)
+	rw.copyResponseHeaders()
 
 	// Save parameter values for log.
 	rw.bytesWritten = int64(len(error) + 1) // account for appended newline
@@ -76,11 +211,91 @@ func (rw *responseWriter) handlerError(error string, status int) {
 	rw.writeHeader(status)
 }
 
-func (rw *responseWriter) handlerTimeout(error string, status int) {
+// handlerTimeout responds to the client after the request context is done, and
+// returns true, unless the downstream handler has already hijacked the
+// connection, in which case it does nothing and returns false.
+//
+// When the context was canceled because the client disconnected, nothing is
+// sent to the client, and the request is logged with the specified disconnect
+// status.  When the deadline was exceeded, the specified timeout handler
+// renders the response, or when it is nil, a 503 error is sent.
+func (rw *responseWriter) handlerTimeout(r *http.Request, err error, disconnectStatus int, timeoutHandler http.Handler) bool {
 	rw.lock.Lock()
-	rw.handlerError(error, status)
+	if rw.hijacked != nil {
+		rw.lock.Unlock()
+		return false
+	}
 	rw.timedOut = true // When handler attempts to Write it will receive appropriate error.
+
+	if rw.streaming && rw.committed {
+		// The downstream handler may be in the middle of writing to the
+		// client, perhaps blocked because the client stopped reading.  Expire
+		// the write deadline so that write fails promptly, then wait for it to
+		// return, because the underlying http.ResponseWriter must not be used
+		// after this handler returns.  Because timedOut is already set, no
+		// further writes will be attempted.
+		rw.lock.Unlock()
+		_ = http.NewResponseController(rw.responseWriter).SetWriteDeadline(time.Now())
+		rw.writeLock.Lock()
+		rw.writeLock.Unlock()
+		rw.lock.Lock()
+	}
+
+	switch {
+	case err == context.Canceled:
+		// There is nobody to whom a response can be sent.
+		rw.disconnected = true
+		rw.end = time.Now()
+		rw.responseError = err.Error()
+		if !rw.committed {
+			// When the response was committed, its status was already sent,
+			// and is the one logged.
+			rw.writeHeader(disconnectStatus)
+		}
+	case rw.committed || timeoutHandler == nil:
+		// Returning a 503 because this is what http.TimeoutHandler returns for
+		// same case.
+		rw.handlerError(err.Error(), http.StatusServiceUnavailable)
+	default:
+		// The timeout handler is not invoked with the lock held, so it may
+		// call functions that acquire it, and so the lock is not left held
+		// when it panics.  Because timedOut is already set, the downstream
+		// handler can no longer write the response.
+		rw.lock.Unlock()
+		trw := rw.respond(func(w http.ResponseWriter) {
+			timeoutHandler.ServeHTTP(w, r)
+		})
+		rw.lock.Lock()
+		rw.recordResponse(err.Error(), trw)
+	}
 	rw.lock.Unlock()
+	return true
+}
+
+// handlerRespond invokes the specified function to write a response directly to
+// the client in place of the downstream handler's response, recording its
+// status and size, along with the specified error, for the log.
+func (rw *responseWriter) handlerRespond(error string, respond func(http.ResponseWriter)) {
+	rw.recordResponse(error, rw.respond(respond))
+}
+
+// respond invokes the specified function to write a response directly to the
+// client, and returns the response writer that recorded its status and size.
+func (rw *responseWriter) respond(respond func(http.ResponseWriter)) *responseWriter {
+	trw := &responseWriter{begin: rw.begin, responseWriter: rw.responseWriter, streaming: true}
+	respond(trw.handlerWriter())
+	trw.handlerComplete()
+	return trw
+}
+
+// recordResponse records the status and size of the response written by
+// respond, along with the specified error, for the log.
+func (rw *responseWriter) recordResponse(error string, trw *responseWriter) {
+	rw.bytesWritten = trw.bytesWritten
+	rw.end = trw.end
+	rw.responseError = error
+	rw.writeHeader(trw.responseStatus)
+	rw.copyResponseHeaders()
 }
 
 // Header returns the header map that will be sent by WriteHeader.
@@ -93,30 +308,124 @@ func (rw *responseWriter) Header() http.Header {
 	return rw.responseHeaders
 }
 
-// Message stores a message
+// streamingResponseWriter is the http.ResponseWriter given to the downstream
+// handler when streaming.  Only it implements http.Flusher, so that handlers
+// which assert http.Flusher to detect whether they can stream the response,
+// such as httputil.ReverseProxy, are not fooled into writing to a response
+// that is buffered until they return.
+type streamingResponseWriter struct {
+	*responseWriter
+}
+
+// handlerWriter returns the http.ResponseWriter to give to a handler writing
+// the response.
+func (rw *responseWriter) handlerWriter() http.ResponseWriter {
+	if rw.streaming {
+		return streamingResponseWriter{rw}
+	}
+	return rw
+}
+
+// Flush sends any buffered data to the client.
+func (srw streamingResponseWriter) Flush() {
+	rw := srw.responseWriter
+	rw.writeLock.Lock()
+	defer rw.writeLock.Unlock()
+
+	rw.lock.Lock()
+	if rw.timedOut || rw.hijacked != nil {
+		rw.lock.Unlock()
+		return
+	}
+	if !rw.wroteHeader {
+		rw.writeHeader(http.StatusOK)
+	}
+	if !rw.committed {
+		rw.commit()
+	}
+	rw.lock.Unlock()
+
+	// Like Write, flushing may block on the client, so lock is not held.
+	if f, ok := rw.responseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Message stores the message emitted by the {message} log directive.  Because
+// the responseWriter type is not exported, handlers ought to call
+// gohm.SetMessage instead.
 func (rw *responseWriter) Message(m string) {
 	rw.responseMessage.Store(m)
 }
 
 // Write writes the data to the connection as part of an HTTP reply.
 func (rw *responseWriter) Write(blob []byte) (int, error) {
+	if rw.streaming {
+		return rw.writeStreaming(blob)
+	}
+
 	rw.lock.Lock()
 	if rw.timedOut {
 		rw.lock.Unlock()
 		return 0, http.ErrHandlerTimeout // inform handler it is beyond timeout
 	}
+	if rw.hijacked != nil {
+		rw.lock.Unlock()
+		return 0, http.ErrHijacked
+	}
 	if !rw.wroteHeader {
 		rw.writeHeader(http.StatusOK)
 	}
+	if rw.maxResponseBytes > 0 && int64(rw.responseBody.Len()+len(blob)) > rw.maxResponseBytes {
+		rw.tooLarge = true
+		rw.lock.Unlock()
+		return 0, ErrResponseTooLarge
+	}
 	n, err := rw.responseBody.Write(blob)
 	rw.lock.Unlock()
 	return n, err
 }
 
+// writeStreaming writes the data through to the client.  The write may block
+// for as long as the client does not read, so it is made while holding
+// writeLock rather than lock, leaving handlerTimeout free to respond to the
+// timeout without waiting for the write to complete.
+func (rw *responseWriter) writeStreaming(blob []byte) (int, error) {
+	rw.writeLock.Lock()
+	defer rw.writeLock.Unlock()
+
+	rw.lock.Lock()
+	if rw.timedOut {
+		rw.lock.Unlock()
+		return 0, http.ErrHandlerTimeout // inform handler it is beyond timeout
+	}
+	if rw.hijacked != nil {
+		rw.lock.Unlock()
+		return 0, http.ErrHijacked
+	}
+	if !rw.wroteHeader {
+		rw.writeHeader(http.StatusOK)
+	}
+	if !rw.committed {
+		rw.commit()
+	}
+	rw.lock.Unlock()
+
+	n, err := rw.responseWriter.Write(blob)
+
+	rw.lock.Lock()
+	rw.bytesWritten += int64(n)
+	if err != nil {
+		rw.responseError = err.Error()
+	}
+	rw.lock.Unlock()
+	return n, err
+}
+
 // WriteHeader sends an HTTP response header with the provided status code.
 func (rw *responseWriter) WriteHeader(status int) {
 	rw.lock.Lock()
-	if !(rw.timedOut || rw.wroteHeader) {
+	if !(rw.timedOut || rw.wroteHeader || rw.hijacked != nil) {
 		rw.writeHeader(status)
 	}
 	rw.lock.Unlock()
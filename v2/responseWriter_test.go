@@ -2,14 +2,18 @@ package gohm_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/karrick/gobp"
@@ -251,3 +255,332 @@ func TestEscrowTestBodyNoErrors(t *testing.T) {
 		t.Errorf("GOT: %v; WANT: %v", got, want)
 	}
 }
+
+func TestResponseWriterMaxResponseBytes(t *testing.T) {
+	t.Run("within limit", func(t *testing.T) {
+		var counters gohm.Counters
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("12345"))
+		}), gohm.Config{Counters: &counters, MaxResponseBytes: 5})
+
+		handler.ServeHTTP(recorder, request)
+
+		resp := recorder.Result()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := string(body), "12345"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetTooLarge(), uint64(0); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("exceeds limit", func(t *testing.T) {
+		var counters gohm.Counters
+		var writeErr error
+		logOutput := new(bytes.Buffer)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("1234"))
+			_, writeErr = w.Write([]byte("56"))
+		}), gohm.Config{
+			Counters:               &counters,
+			LogFormat:              "{status} {error}",
+			LogWriter:              logOutput,
+			MaxResponseBytes:       5,
+			MaxResponseBytesStatus: http.StatusBadGateway,
+		})
+
+		handler.ServeHTTP(recorder, request)
+
+		resp := recorder.Result()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := writeErr, gohm.ErrResponseTooLarge; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := resp.StatusCode, http.StatusBadGateway; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := resp.Header.Get("Content-Type"), "application/json"; got == want {
+			t.Errorf("GOT: %v; WANT: not %v", got, want)
+		}
+		if got, want := string(body), "1234"; strings.Contains(got, want) {
+			t.Errorf("GOT: %v; WANT: not %v", got, want)
+		}
+		if got, want := logOutput.String(), "502 response body exceeds 5 bytes\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+		if got, want := counters.GetTooLarge(), uint64(1); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetAndResetTooLarge(), uint64(1); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetTooLarge(), uint64(0); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("exceeds limit then times out", func(t *testing.T) {
+		var counters gohm.Counters
+		release := make(chan struct{})
+		defer close(release)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("123456"))
+			<-release
+		}), gohm.Config{
+			Counters:         &counters,
+			MaxResponseBytes: 5,
+			Timeout:          5 * time.Millisecond,
+		})
+
+		handler.ServeHTTP(recorder, request)
+
+		// The client received the timeout response, so the response is not
+		// counted as too large.
+		if got, want := recorder.Code, http.StatusServiceUnavailable; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := counters.GetTooLarge(), uint64(0); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
+
+func TestEscrowMaxRequestBytes(t *testing.T) {
+	const payload = "flubber"
+
+	test := func(t *testing.T, body io.Reader, wantStatus int, wantBody string, wantTruncated bool) {
+		t.Helper()
+
+		var handlerInvoked, callbackTruncated bool
+		var callbackBody []byte
+		var callbackError string
+		logOutput := new(bytes.Buffer)
+
+		wrapper := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerInvoked = true
+			ioutil.ReadAll(r.Body)
+		}), gohm.Config{
+			Callback: func(stats *gohm.Statistics) {
+				callbackBody = stats.RequestBody
+				callbackError = stats.Error
+				callbackTruncated = stats.RequestBodyTruncated
+			},
+			EscrowReader:    true,
+			LogFormat:       "{status} {error}",
+			LogWriter:       logOutput,
+			MaxRequestBytes: 4,
+		})
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/some/url", body)
+
+		wrapper.ServeHTTP(recorder, request)
+
+		if got, want := recorder.Code, wantStatus; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := handlerInvoked, wantStatus == http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := string(callbackBody), wantBody; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := callbackTruncated, wantTruncated; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		wantError := ""
+		wantLog := strconv.Itoa(wantStatus) + " -\n"
+		if wantStatus == http.StatusRequestEntityTooLarge {
+			wantError = "request body exceeds 4 bytes"
+			wantLog = "413 request body exceeds 4 bytes\n"
+		}
+		if got, want := callbackError, wantError; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+		if got, want := logOutput.String(), wantLog; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	}
+
+	t.Run("within limit", func(t *testing.T) {
+		test(t, strings.NewReader(payload[:4]), http.StatusOK, payload[:4], false)
+	})
+
+	t.Run("content length exceeds limit", func(t *testing.T) {
+		test(t, strings.NewReader(payload), http.StatusRequestEntityTooLarge, payload[:4], true)
+	})
+
+	t.Run("chunked exceeds limit", func(t *testing.T) {
+		// ioutil.NopCloser hides the length of the body, so the request has
+		// no Content-Length.
+		test(t, ioutil.NopCloser(strings.NewReader(payload)), http.StatusRequestEntityTooLarge, payload[:4], true)
+	})
+
+	t.Run("read error at limit", func(t *testing.T) {
+		// A body as long as the limit that fails for another reason is not
+		// too large.
+		body := io.MultiReader(strings.NewReader(payload[:4]), iotest.ErrReader(errors.New("some read error")))
+		test(t, ioutil.NopCloser(body), http.StatusOK, payload[:4], false)
+	})
+}
+
+func TestMaxRequestBytesWithoutEscrow(t *testing.T) {
+	const payload = "flubber"
+
+	var callbackStatus int
+	var callbackTruncated bool
+
+	wrapper := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("read entire body"))
+	}), gohm.Config{
+		Callback: func(stats *gohm.Statistics) {
+			callbackStatus = stats.ResponseStatus
+			callbackTruncated = stats.RequestBodyTruncated
+		},
+		MaxRequestBytes: 4,
+	})
+
+	recorder := httptest.NewRecorder()
+	// ioutil.NopCloser hides the length of the body, so the request has no
+	// Content-Length, and the limit is only reached by the handler.
+	request := httptest.NewRequest(http.MethodPost, "/some/url", ioutil.NopCloser(strings.NewReader(payload)))
+
+	wrapper.ServeHTTP(recorder, request)
+
+	if got, want := recorder.Code, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := recorder.Body.String(), "413 Request Entity Too Large: request body exceeds 4 bytes\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := callbackStatus, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := callbackTruncated, true; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestCallbackStatistics(t *testing.T) {
+	t.Run("completed", func(t *testing.T) {
+		var stats gohm.Statistics
+
+		wrapper := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = "/modified" // callback ought to see original
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("accepted"))
+		}), gohm.Config{
+			Callback: func(s *gohm.Statistics) {
+				stats = *s
+				stats.ResponseBody = append([]byte(nil), s.ResponseBody...) // copy because buffer reused
+			},
+		})
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPut, "/some/url?q=1", nil)
+		wrapper.ServeHTTP(recorder, request)
+
+		if got, want := stats.RequestMethod, http.MethodPut; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.RequestURL.String(), "/some/url?q=1"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.ResponseStatus, http.StatusAccepted; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.ResponseHeader.Get("Content-Type"), "text/plain"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := string(stats.ResponseBody), "accepted"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.ResponseBytes, int64(len("accepted")); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.Error, ""; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if stats.ClientDisconnected || stats.Panicked || stats.TimedOut {
+			t.Errorf("GOT: %v %v %v; WANT: all false", stats.ClientDisconnected, stats.Panicked, stats.TimedOut)
+		}
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		var stats gohm.Statistics
+
+		wrapper := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+		}), gohm.Config{
+			Callback: func(s *gohm.Statistics) { stats = *s },
+			Timeout:  5 * time.Millisecond,
+		})
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		wrapper.ServeHTTP(recorder, request)
+
+		if got, want := stats.TimedOut, true; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.Error, "context deadline exceeded"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.ResponseStatus, http.StatusServiceUnavailable; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("panicked", func(t *testing.T) {
+		var stats gohm.Statistics
+
+		wrapper := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}), gohm.Config{
+			Callback: func(s *gohm.Statistics) { stats = *s },
+		})
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		wrapper.ServeHTTP(recorder, request)
+
+		if got, want := stats.Panicked, true; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.Error, "boom"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := stats.ResponseStatus, http.StatusInternalServerError; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,342 @@
+package gohm
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rotatedLayout is the layout of the UTC timestamp appended to the name of a
+// rotated log file.  It sorts in chronological order, and has enough
+// precision that files rotated in quick succession have distinct names.
+const rotatedLayout = "2006-01-02T15-04-05.000000000"
+
+// RotatingFileWriterConfig holds parameters for configuring a
+// RotatingFileWriter.
+type RotatingFileWriterConfig struct {
+	// Compress, when true, causes rotated log files to be compressed with
+	// gzip, by a background goroutine, after they are rotated.
+	Compress bool
+
+	// Header, when not nil, is called each time a new, empty log file is
+	// opened, and the bytes it returns are written at the start of the file.
+	// For example, set it to W3CHeader when logging with W3CExtendedLogFormat.
+	Header func(now time.Time) []byte
+
+	// Interval, when not 0, causes the log file to be rotated when the first
+	// line is written after the end of the interval in which the file was
+	// opened.  Intervals are aligned to the zero time, so an Interval of
+	// 24 * time.Hour rotates the log file daily, at midnight UTC.
+	Interval time.Duration
+
+	// MaxBackups is the number of rotated log files kept.  When a log file is
+	// rotated, the oldest rotated log files beyond this number are removed.
+	// When 0, rotated log files are never removed.
+	MaxBackups int
+
+	// MaxBytes, when not 0, causes the log file to be rotated before a line
+	// is written that would make it larger than MaxBytes.
+	MaxBytes int64
+}
+
+// RotatingFileWriter is an io.Writer that appends log lines to a file, and
+// rotates it by size, by time, or both.  A rotated log file is renamed by
+// appending the UTC time it was rotated to its name, e.g.,
+// "access.log.2006-01-02T15-04-05.000000000", optionally compressed, and a new
+// log file is created.  Each call to Write is treated as one log line, and is
+// written entirely to one file, without being interleaved with lines written
+// concurrently.
+//
+// For logrotate style workflows, where another program renames the log file,
+// call the Reopen method, or have the ReopenOnSignal method call it upon
+// SIGHUP, to create a new log file with the original name.
+//
+//	logWriter, err := gohm.NewRotatingFileWriter("/var/log/app/access.log", gohm.RotatingFileWriterConfig{
+//		Compress:   true,
+//		MaxBackups: 7,
+//		MaxBytes:   100 << 20,
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer logWriter.Close()
+//	logWriter.ReopenOnSignal()
+//	h := gohm.New(someHandler, gohm.Config{LogWriter: logWriter})
+type RotatingFileWriter struct {
+	path   string
+	config RotatingFileWriterConfig
+
+	lock   sync.Mutex
+	file   *os.File  // file is nil after Close, or after it could not be opened
+	size   int64     // size is the number of bytes in file
+	header int64     // header is the number of bytes of file written by Header
+	period time.Time // period is the start of the interval in which file was opened
+	closed bool
+
+	signals     chan os.Signal // signals, when not nil, receives signals that cause file to be reopened
+	maintenance sync.Mutex     // maintenance serializes compressing and removing rotated files
+	maintainers sync.WaitGroup
+}
+
+// NewRotatingFileWriter returns a RotatingFileWriter that appends log lines to
+// the file at the specified path, creating the file when it does not exist.
+func NewRotatingFileWriter(path string, config RotatingFileWriterConfig) (*RotatingFileWriter, error) {
+	rfw := &RotatingFileWriter{path: path, config: config}
+	if err := rfw.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return rfw, nil
+}
+
+// Write appends the specified log line to the log file, after rotating the log
+// file when required.  When the log file could not be rotated, the line is
+// appended to the current log file, and the error is returned.  When the log
+// file could not be opened by an earlier call, it attempts to open it again.
+func (rfw *RotatingFileWriter) Write(p []byte) (int, error) {
+	rfw.lock.Lock()
+	defer rfw.lock.Unlock()
+
+	if rfw.closed {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	if rfw.file == nil {
+		if err := rfw.open(now); err != nil {
+			return 0, err
+		}
+	}
+
+	var rotateErr error
+	if rfw.size > rfw.header && (rfw.config.MaxBytes > 0 && rfw.size+int64(len(p)) > rfw.config.MaxBytes ||
+		rfw.config.Interval > 0 && !now.Truncate(rfw.config.Interval).Equal(rfw.period)) {
+		if rotateErr = rfw.rotate(now); rfw.file == nil {
+			return 0, rotateErr
+		}
+	}
+
+	n, err := rfw.file.Write(p)
+	rfw.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Rotate rotates the log file, regardless of its size or age.
+func (rfw *RotatingFileWriter) Rotate() error {
+	rfw.lock.Lock()
+	defer rfw.lock.Unlock()
+
+	if rfw.closed {
+		return os.ErrClosed
+	}
+	return rfw.rotate(time.Now())
+}
+
+// Reopen closes the log file, then opens the file at the original path,
+// creating it when it does not exist.  Call it after another program, such as
+// logrotate, renames the log file.
+func (rfw *RotatingFileWriter) Reopen() error {
+	rfw.lock.Lock()
+	defer rfw.lock.Unlock()
+
+	if rfw.closed {
+		return os.ErrClosed
+	}
+	if rfw.file != nil {
+		_ = rfw.file.Close()
+		rfw.file = nil
+	}
+	return rfw.open(time.Now())
+}
+
+// ReopenOnSignal causes the log file to be reopened each time the process
+// receives one of the specified signals, or SIGHUP when none are specified,
+// until Close is called.  When the log file cannot be reopened, the next call
+// to Write tries again.
+func (rfw *RotatingFileWriter) ReopenOnSignal(sig ...os.Signal) {
+	if len(sig) == 0 {
+		sig = []os.Signal{syscall.SIGHUP}
+	}
+
+	rfw.lock.Lock()
+	defer rfw.lock.Unlock()
+
+	if rfw.closed || rfw.signals != nil {
+		return
+	}
+	rfw.signals = make(chan os.Signal, 1)
+	signal.Notify(rfw.signals, sig...)
+
+	go func(signals <-chan os.Signal) {
+		for range signals {
+			_ = rfw.Reopen()
+		}
+	}(rfw.signals)
+}
+
+// Close closes the log file, stops reopening it upon signals, and waits for
+// rotated log files to be compressed and removed.
+func (rfw *RotatingFileWriter) Close() error {
+	rfw.lock.Lock()
+	if rfw.closed {
+		rfw.lock.Unlock()
+		return os.ErrClosed
+	}
+	rfw.closed = true
+
+	var err error
+	if rfw.file != nil {
+		err = rfw.file.Close()
+		rfw.file = nil
+	}
+	if rfw.signals != nil {
+		signal.Stop(rfw.signals)
+		close(rfw.signals)
+	}
+	rfw.lock.Unlock()
+
+	rfw.maintainers.Wait()
+	return err
+}
+
+// open opens the log file.  It must be called with the lock held.
+func (rfw *RotatingFileWriter) open(now time.Time) error {
+	if dir := filepath.Dir(rfw.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(rfw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	rfw.file, rfw.size, rfw.header = file, fi.Size(), 0
+	if rfw.size == 0 && rfw.config.Header != nil {
+		n, err := file.Write(rfw.config.Header(now))
+		if err != nil {
+			_ = file.Close()
+			rfw.file = nil
+			return err
+		}
+		rfw.size, rfw.header = int64(n), int64(n)
+	}
+	if rfw.config.Interval > 0 {
+		rfw.period = now.Truncate(rfw.config.Interval)
+	}
+	return nil
+}
+
+// rotate renames the log file, opens a new log file, and starts a goroutine to
+// compress the renamed log file and remove the oldest rotated log files.  It
+// must be called with the lock held.  When the log file cannot be renamed, it
+// continues to use the existing log file.
+func (rfw *RotatingFileWriter) rotate(now time.Time) error {
+	if rfw.file != nil {
+		if err := rfw.file.Close(); err != nil {
+			rfw.file = nil
+			return err
+		}
+		rfw.file = nil
+	}
+
+	rotated := rfw.path + "." + now.UTC().Format(rotatedLayout)
+	renameErr := os.Rename(rfw.path, rotated)
+
+	if err := rfw.open(now); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	rfw.maintainers.Add(1)
+	go func() {
+		defer rfw.maintainers.Done()
+		rfw.maintenance.Lock()
+		defer rfw.maintenance.Unlock()
+
+		if rfw.config.Compress {
+			_ = compressFile(rotated)
+		}
+		if rfw.config.MaxBackups > 0 {
+			rfw.removeOldest()
+		}
+	}()
+	return nil
+}
+
+// removeOldest removes the oldest rotated log files beyond MaxBackups.
+func (rfw *RotatingFileWriter) removeOldest() {
+	dir, base := filepath.Split(rfw.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	prefix := base + "."
+	var rotated []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// Only consider files named by rotate, so other files with similar
+		// names are never removed.
+		stamp := strings.TrimSuffix(name[len(prefix):], ".gz")
+		if _, err := time.Parse(rotatedLayout, stamp); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	if len(rotated) <= rfw.config.MaxBackups {
+		return
+	}
+
+	sort.Strings(rotated) // oldest first
+	for _, name := range rotated[:len(rotated)-rfw.config.MaxBackups] {
+		_ = os.Remove(filepath.Join(dir, name))
+	}
+}
+
+// compressFile compresses the specified file with gzip, replacing it with a
+// file of the same name with ".gz" appended.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err2 := zw.Close(); err == nil {
+		err = err2
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,296 @@
+package gohm_test
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+// rotatedFiles returns the names of the rotated log files in the specified
+// directory, oldest first.
+func rotatedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, "access.log.") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestRotatingFileWriterRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	rfw, err := gohm.NewRotatingFileWriter(path, gohm.RotatingFileWriterConfig{MaxBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+		if _, err := rfw.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rfw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readFile(t, path), "line 3\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	rotated := rotatedFiles(t, dir)
+	if got, want := len(rotated), 2; got != want {
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+	for i, want := range []string{"line 1\n", "line 2\n"} {
+		if got := readFile(t, filepath.Join(dir, rotated[i])); got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	}
+}
+
+func TestRotatingFileWriterRotatesByTime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	rfw, err := gohm.NewRotatingFileWriter(path, gohm.RotatingFileWriterConfig{Interval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rfw.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if _, err := rfw.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rfw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readFile(t, path), "after\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	rotated := rotatedFiles(t, dir)
+	if got, want := len(rotated), 1; got != want {
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := readFile(t, filepath.Join(dir, rotated[0])), "before\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestRotatingFileWriterMaxBackupsAndCompress(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	// A file with a similar name must not be removed.
+	other := filepath.Join(dir, "access.log.keep")
+	if err := os.WriteFile(other, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rfw, err := gohm.NewRotatingFileWriter(path, gohm.RotatingFileWriterConfig{Compress: true, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if _, err := rfw.Write([]byte("line " + strconv.Itoa(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := rfw.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rfw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := rotatedFiles(t, dir)
+	if got, want := len(rotated), 3; got != want {
+		t.Fatalf("GOT: %v; WANT: %v (%v)", got, want, rotated)
+	}
+	if got, want := rotated[2], "access.log.keep"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	for i, want := range []string{"line 4\n", "line 5\n"} {
+		if !strings.HasSuffix(rotated[i], ".gz") {
+			t.Errorf("GOT: %v; WANT: .gz suffix", rotated[i])
+		}
+		if got := readFile(t, filepath.Join(dir, rotated[i])); got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	}
+}
+
+func TestRotatingFileWriterReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	moved := filepath.Join(dir, "moved.log")
+
+	rfw, err := gohm.NewRotatingFileWriter(path, gohm.RotatingFileWriterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfw.Close()
+
+	if _, err := rfw.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Like logrotate, rename the log file, then ask the writer to reopen it.
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := rfw.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rfw.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readFile(t, moved), "before\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := readFile(t, path), "after\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestRotatingFileWriterReopenOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("cannot send SIGHUP on windows")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	moved := filepath.Join(dir, "moved.log")
+
+	rfw, err := gohm.NewRotatingFileWriter(path, gohm.RotatingFileWriterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfw.Close()
+	rfw.ReopenOnSignal()
+
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Skip("cannot send SIGHUP:", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("GOT: log file not reopened; WANT: log file reopened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRotatingFileWriterConcurrentLinesNotInterleaved(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	rfw, err := gohm.NewRotatingFileWriter(path, gohm.RotatingFileWriterConfig{MaxBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.Repeat("x", 99) + "\n"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := rfw.Write([]byte(line)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := rfw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines int
+	for _, name := range append(rotatedFiles(t, dir), "access.log") {
+		contents := readFile(t, filepath.Join(dir, name))
+		if got, want := len(contents), 1000; got > want {
+			t.Errorf("GOT: %v; WANT: <= %v", got, want)
+		}
+		for _, l := range strings.SplitAfter(contents, "\n") {
+			if l == "" {
+				continue
+			}
+			if l != line {
+				t.Fatalf("GOT: %q; WANT: %q", l, line)
+			}
+			lines++
+		}
+	}
+	if got, want := lines, 500; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestRotatingFileWriterClosed(t *testing.T) {
+	rfw, err := gohm.NewRotatingFileWriter(filepath.Join(t.TempDir(), "access.log"), gohm.RotatingFileWriterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rfw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rfw.Write([]byte("line\n")); err == nil {
+		t.Errorf("GOT: %v; WANT: error", err)
+	}
+}
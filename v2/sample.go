@@ -0,0 +1,75 @@
+package gohm
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// samplingScale is the number of parts into which log sampling rates are
+// divided: rates are stored with a precision of one part per million.
+const samplingScale = 1000000
+
+// LogSampleRates specifies the fraction of requests in each HTTP status class
+// that are logged.  The zero value logs all requests.  Rates may be changed
+// even after creating the http.Handler, because they are accessed using the
+// sync/atomic package.
+//
+//	sampleRates := new(gohm.LogSampleRates)
+//	sampleRates.Set(2, 0.01) // log 1% of 2xx responses, and all others
+//	mux.Handle("/example/path", gohm.New(someHandler, gohm.Config{
+//		LogSampleRates: sampleRates,
+//		LogWriter:      os.Stderr,
+//	}))
+type LogSampleRates struct {
+	// skipped holds the number of parts per million of requests in each status
+	// class, 1xx through 5xx, that are not logged, so the zero value logs all
+	// requests.
+	skipped [5]uint32
+}
+
+// Get returns the fraction, between 0 and 1, of requests with the specified
+// status class, 1 through 5, that are logged.
+func (s *LogSampleRates) Get(statusClass int) float64 {
+	return float64(s.ppm(statusClass)) / samplingScale
+}
+
+// Set changes the fraction of requests with the specified status class, 1
+// through 5, that are logged.  The rate is clamped between 0, which logs none
+// of them, and 1, which logs all of them.  It does nothing when the status
+// class is out of range.
+func (s *LogSampleRates) Set(statusClass int, rate float64) {
+	if statusClass < 1 || statusClass > 5 {
+		return
+	}
+	var ppm uint32
+	switch {
+	case rate >= 1:
+		ppm = samplingScale
+	case rate > 0:
+		ppm = uint32(rate*samplingScale + 0.5)
+	}
+	atomic.StoreUint32(&s.skipped[statusClass-1], samplingScale-ppm)
+}
+
+// ppm returns the number of parts per million of requests with the specified
+// status class that are logged.
+func (s *LogSampleRates) ppm(statusClass int) uint32 {
+	if statusClass < 1 || statusClass > 5 {
+		return samplingScale
+	}
+	return samplingScale - atomic.LoadUint32(&s.skipped[statusClass-1])
+}
+
+// sample randomly decides whether to log a request with the specified status
+// class, and returns that decision, along with the sampling rate applied, in
+// parts per million.
+func (s *LogSampleRates) sample(statusClass int) (bool, uint32) {
+	ppm := s.ppm(statusClass)
+	switch ppm {
+	case 0:
+		return false, 0
+	case samplingScale:
+		return true, ppm
+	}
+	return uint32(rand.Int31n(samplingScale)) < ppm, ppm
+}
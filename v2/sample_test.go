@@ -0,0 +1,117 @@
+package gohm_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestLogSampleRates(t *testing.T) {
+	t.Run("zero value logs all", func(t *testing.T) {
+		var sampleRates gohm.LogSampleRates
+		for class := 1; class <= 5; class++ {
+			if got, want := sampleRates.Get(class), 1.0; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+		}
+	})
+
+	t.Run("set clamps rate", func(t *testing.T) {
+		var sampleRates gohm.LogSampleRates
+		sampleRates.Set(2, 0.01)
+		sampleRates.Set(4, -1)
+		sampleRates.Set(5, 2)
+		sampleRates.Set(6, 0) // ignored
+
+		for class, want := range map[int]float64{1: 1, 2: 0.01, 3: 1, 4: 0, 5: 1} {
+			if got := sampleRates.Get(class); got != want {
+				t.Errorf("class %d: GOT: %v; WANT: %v", class, got, want)
+			}
+		}
+	})
+
+	t.Run("samples per status class", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		sampleRates := new(gohm.LogSampleRates)
+		sampleRates.Set(2, 0)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/error" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}), gohm.Config{
+			LogFormat:      "{status} {sampled} {sample-rate}",
+			LogSampleRates: sampleRates,
+			LogWriter:      logOutput,
+		})
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/error", nil))
+
+		if got, want := logOutput.String(), "500 true 1\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+
+		// Rates may be changed after creating handler.
+		logOutput.Reset()
+		sampleRates.Set(2, 1)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+
+		if got, want := logOutput.String(), "200 true 1\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("partial rate", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		sampleRates := new(gohm.LogSampleRates)
+		sampleRates.Set(2, 0.5)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), gohm.Config{
+			LogFormat:      "{sampled} {sample-rate}",
+			LogSampleRates: sampleRates,
+			LogWriter:      logOutput,
+		})
+
+		const requests = 1000
+		for i := 0; i < requests; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+		}
+
+		lines := strings.Count(logOutput.String(), "true 0.5\n")
+		if lines < requests/4 || lines > requests*3/4 {
+			t.Errorf("GOT: %v; WANT: about %v", lines, requests/2)
+		}
+		if got, want := strings.Count(logOutput.String(), "\n"), lines; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
+
+func TestLogSlowThreshold(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+	logBitmask := gohm.LogStatusErrors
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}), gohm.Config{
+		LogBitmask:       &logBitmask,
+		LogFormat:        "{uri} {status} {sampled}",
+		LogSlowThreshold: 5 * time.Millisecond,
+		LogWriter:        logOutput,
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+
+	if got, want := logOutput.String(), "/slow 200 false\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package gohm
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// slogMessage is the message of each record gohm emits to Config.Logger.
+const slogMessage = "http request"
+
+// compileSlogFormat converts the parsed log line format into a slice of
+// functions to invoke when creating a log/slog record, each returning one
+// attribute, and returns the names of the request headers the format refers
+// to.  Like compileJSONFormat, each directive becomes an attribute named by the
+// directive unless the specified names map provides another name for it, and
+// constant text in the format is ignored.  Times and durations are emitted as
+// slog.Time and slog.Duration values, numeric directives as numbers, and
+// directives that have no value are omitted.
+func compileSlogFormat(segments []logSegment, names map[string]string) ([]func(*responseWriter, *http.Request, *[]byte) slog.Attr, []string) {
+	var emitters []func(*responseWriter, *http.Request, *[]byte) slog.Attr
+	hm := make(map[string]struct{})
+
+	for _, segment := range segments {
+		tok := segment.directive // handlers escape values themselves, so the modifier is ignored
+		if tok == "" {
+			continue
+		}
+		emitter, kind, header := directiveEmitter(tok)
+		if header != "" {
+			hm[header] = struct{}{}
+		}
+
+		name, ok := names[tok]
+		if !ok {
+			name = tok
+		}
+
+		switch tok {
+		case "begin", "begin-epoch", "begin-iso8601":
+			emitters = append(emitters, func(grw *responseWriter, _ *http.Request, _ *[]byte) slog.Attr {
+				return slog.Time(name, grw.begin)
+			})
+		case "end", "end-epoch", "end-iso8601":
+			emitters = append(emitters, func(grw *responseWriter, _ *http.Request, _ *[]byte) slog.Attr {
+				return slog.Time(name, grw.end)
+			})
+		case "duration":
+			emitters = append(emitters, func(grw *responseWriter, _ *http.Request, _ *[]byte) slog.Attr {
+				return slog.Duration(name, grw.end.Sub(grw.begin))
+			})
+		case "timeout":
+			emitters = append(emitters, func(grw *responseWriter, _ *http.Request, _ *[]byte) slog.Attr {
+				if grw.timeout == 0 {
+					return slog.Attr{}
+				}
+				return slog.Duration(name, grw.timeout)
+			})
+		default:
+			emitters = append(emitters, makeSlogEmitter(name, emitter, kind))
+		}
+	}
+
+	return emitters, headerNames(hm)
+}
+
+// makeSlogEmitter returns a function that returns an attribute with the
+// specified name, holding the value emitted by the specified emitter into the
+// scratch buffer, converted to the specified kind.  It returns an empty
+// attribute, which log/slog handlers ignore, when the emitter emits nothing
+// because there is no value.
+func makeSlogEmitter(name string, emitter func(*responseWriter, *http.Request, *[]byte), kind int) func(*responseWriter, *http.Request, *[]byte) slog.Attr {
+	return func(grw *responseWriter, r *http.Request, bb *[]byte) slog.Attr {
+		*bb = (*bb)[:0]
+		emitter(grw, r, bb)
+		value := string(*bb)
+
+		if value == "" {
+			return slog.Attr{}
+		}
+		if kind == boolDirective {
+			if b, err := strconv.ParseBool(value); err == nil {
+				return slog.Bool(name, b)
+			}
+		}
+		if kind == numberDirective {
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return slog.Int64(name, i)
+			}
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				return slog.Float64(name, f)
+			}
+		}
+		return slog.String(name, value)
+	}
+}
+
+// slogLevel returns the level of the record for a request with the specified
+// status class: Info for 1xx, 2xx, and 3xx, Warn for 4xx, and Error for 5xx or
+// when the downstream handler panicked.
+func slogLevel(statusClass int, panicked bool) slog.Level {
+	switch {
+	case panicked || statusClass >= 5:
+		return slog.LevelError
+	case statusClass == 4:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// emitSlogRecord emits one record describing the request to the specified
+// logger, unless the logger is not enabled for the record's level.
+func emitSlogRecord(ctx context.Context, logger *slog.Logger, emitters []func(*responseWriter, *http.Request, *[]byte) slog.Attr, grw *responseWriter, r *http.Request, level slog.Level) {
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	record := slog.NewRecord(grw.end, level, slogMessage, 0)
+	buf := make([]byte, 0, 128)
+	for _, emitter := range emitters {
+		if attr := emitter(grw, r, &buf); attr.Key != "" {
+			record.AddAttrs(attr)
+		}
+	}
+	_ = logger.Handler().Handle(ctx, record)
+}
@@ -0,0 +1,211 @@
+package gohm_test
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+// recordingHandler is a slog.Handler that records the records it handles.
+type recordingHandler struct {
+	lock    sync.Mutex
+	level   slog.Level
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordingHandler) Handle(_ context.Context, record slog.Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.records = append(h.records, record)
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+func recordAttrs(record slog.Record) map[string]slog.Value {
+	attrs := make(map[string]slog.Value)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs[attr.Key] = attr.Value
+		return true
+	})
+	return attrs
+}
+
+func TestLogger(t *testing.T) {
+	t.Run("attributes", func(t *testing.T) {
+		rh := new(recordingHandler)
+
+		request := httptest.NewRequest("GET", "/some/url", nil)
+		request.Header.Set("User-Agent", "test-agent")
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("some body"))
+		}), gohm.Config{
+			LogFieldNames: map[string]string{"http-User-Agent": "user_agent"},
+			LogFormat:     "{client-ip} {begin} {method} {uri} {status} {bytes} {duration} {timeout} {error} {http-User-Agent}",
+			Logger:        slog.New(rh),
+			Timeout:       time.Second,
+		})
+
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if got, want := len(rh.records), 1; got != want {
+			t.Fatalf("GOT: %v; WANT: %v", got, want)
+		}
+		record := rh.records[0]
+		if got, want := record.Level, slog.LevelInfo; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := record.Message, "http request"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		attrs := recordAttrs(record)
+		if got, want := len(attrs), 9; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want) // error omitted
+		}
+		if got, want := attrs["status"].Kind(), slog.KindInt64; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["status"].Int64(), int64(200); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["bytes"].Int64(), int64(9); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["begin"].Kind(), slog.KindTime; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["duration"].Kind(), slog.KindDuration; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["timeout"].Duration(), time.Second; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["user_agent"].String(), "test-agent"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["client-ip"].String(), "192.0.2.1"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("levels", func(t *testing.T) {
+		for _, tc := range []struct {
+			name  string
+			serve func(http.ResponseWriter, *http.Request)
+			level slog.Level
+		}{
+			{"2xx", func(w http.ResponseWriter, r *http.Request) {}, slog.LevelInfo},
+			{"3xx", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotModified) }, slog.LevelInfo},
+			{"4xx", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) }, slog.LevelWarn},
+			{"5xx", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) }, slog.LevelError},
+			{"panic", func(w http.ResponseWriter, r *http.Request) { panic("test panic") }, slog.LevelError},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				rh := new(recordingHandler)
+				handler := gohm.New(http.HandlerFunc(tc.serve), gohm.Config{Logger: slog.New(rh)})
+
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+
+				if got, want := len(rh.records), 1; got != want {
+					t.Fatalf("GOT: %v; WANT: %v", got, want)
+				}
+				if got, want := rh.records[0].Level, tc.level; got != want {
+					t.Errorf("GOT: %v; WANT: %v", got, want)
+				}
+			})
+		}
+	})
+
+	t.Run("bitmask and statistics override", func(t *testing.T) {
+		rh := new(recordingHandler)
+		logBitmask := gohm.LogStatusErrors
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/forced" {
+				w.Header().Set("X-Force-Log", "true")
+			}
+		}), gohm.Config{
+			Callback: func(s *gohm.Statistics) {
+				if s.ResponseHeader.Get("X-Force-Log") != "" {
+					s.Log()
+				}
+			},
+			LogBitmask: &logBitmask,
+			Logger:     slog.New(rh),
+		})
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/elided", nil))
+		if got, want := len(rh.records), 0; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/forced", nil))
+		if got, want := len(rh.records), 1; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("abandoned handler", func(t *testing.T) {
+		rh := new(recordingHandler)
+		release := make(chan struct{})
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release // ignores context cancellation
+		}), gohm.Config{
+			LogAbandoned: true,
+			LogFormat:    "{status} {error}",
+			Logger:       slog.New(rh),
+			Timeout:      5 * time.Millisecond,
+		})
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+		close(release)
+
+		var records []slog.Record
+		for deadline := time.Now().Add(time.Second); len(records) < 2; {
+			if time.Now().After(deadline) {
+				t.Fatalf("GOT: %v records; WANT: 2", len(records))
+			}
+			time.Sleep(time.Millisecond)
+			rh.lock.Lock()
+			records = append(records[:0], rh.records...)
+			rh.lock.Unlock()
+		}
+
+		if got, want := records[1].Level, slog.LevelWarn; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		attrs := recordAttrs(records[1])
+		if got, want := attrs["status"].Int64(), int64(http.StatusServiceUnavailable); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := attrs["error"].String(), "abandoned handler returned "; !strings.HasPrefix(got, want) {
+			t.Errorf("GOT: %q; WANT PREFIX: %q", got, want)
+		}
+	})
+
+	t.Run("level not enabled", func(t *testing.T) {
+		rh := &recordingHandler{level: slog.LevelWarn}
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), gohm.Config{Logger: slog.New(rh)})
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+
+		if got, want := len(rh.records), 0; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package gohm_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestStreaming(t *testing.T) {
+	t.Run("flushes before handler returns", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+
+		var bodyBeforeReturn string
+		var flushedBeforeReturn bool
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: one\n\n"))
+			f, ok := w.(http.Flusher)
+			if !ok {
+				t.Fatal("response writer ought to implement http.Flusher")
+			}
+			f.Flush()
+			bodyBeforeReturn = recorder.Body.String()
+			flushedBeforeReturn = recorder.Flushed
+			w.Write([]byte("data: two\n\n"))
+		}), gohm.Config{Streaming: true, Timeout: time.Second})
+
+		handler.ServeHTTP(recorder, request)
+
+		if got, want := bodyBeforeReturn, "data: one\n\n"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := flushedBeforeReturn, true; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+
+		resp := recorder.Result()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := string(body), "data: one\n\ndata: two\n\n"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("buffered response cannot be flushed", func(t *testing.T) {
+		// Handlers that stream when the response writer implements
+		// http.Flusher must learn that the response is buffered.
+		var flusher bool
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, flusher = w.(http.Flusher)
+		}), gohm.Config{Timeout: time.Second})
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/some/url", nil))
+
+		if got, want := flusher, false; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("timeout before commit", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+			w.Write([]byte("too late"))
+		}), gohm.Config{Streaming: true, Timeout: 5 * time.Millisecond})
+
+		handler.ServeHTTP(recorder, request)
+
+		resp := recorder.Result()
+		if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+	})
+
+	t.Run("timeout after commit aborts", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Second)
+		}), gohm.Config{
+			LogFormat: "{status} {bytes} {error}",
+			LogWriter: logOutput,
+			Streaming: true,
+			Timeout:   5 * time.Millisecond,
+		})
+
+		var recovered interface{}
+		func() {
+			defer func() { recovered = recover() }()
+			handler.ServeHTTP(recorder, request)
+		}()
+
+		if got, want := recovered, interface{}(http.ErrAbortHandler); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := recorder.Body.String(), "partial"; got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := logOutput.String(), "200 7 context deadline exceeded\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("panic after commit aborts", func(t *testing.T) {
+		logOutput := new(bytes.Buffer)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/some/url", nil)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("partial"))
+			panic("test panic")
+		}), gohm.Config{
+			LogFormat: "{status} {error}",
+			LogWriter: logOutput,
+			Streaming: true,
+		})
+
+		var recovered interface{}
+		func() {
+			defer func() { recovered = recover() }()
+			handler.ServeHTTP(recorder, request)
+		}()
+
+		if got, want := recovered, interface{}(http.ErrAbortHandler); got != want {
+			t.Errorf("GOT: %v; WANT: %v", got, want)
+		}
+		if got, want := logOutput.String(), "test panic"; !strings.Contains(got, want) {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+
+	t.Run("timeout while client not reading aborts", func(t *testing.T) {
+		logOutput := new(syncBuffer)
+		chunk := bytes.Repeat([]byte("x"), 64<<10)
+
+		handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Keep writing until the writes fail, which they will only
+			// after the client's and the server's socket buffers fill.
+			for {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+		}), gohm.Config{
+			LogFormat: "{status} {error}",
+			LogWriter: logOutput,
+			Streaming: true,
+			Timeout:   50 * time.Millisecond,
+		})
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// Send the request, but never read the response.
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+		// The timeout is enforced even though the handler is blocked writing
+		// to the client.
+		for deadline := time.Now().Add(time.Second); logOutput.String() == ""; {
+			if time.Now().After(deadline) {
+				t.Fatal("request not logged after timeout while client not reading")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if got, want := logOutput.String(), "200 context deadline exceeded\n"; got != want {
+			t.Errorf("GOT: %q; WANT: %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package gohm
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RemainingTime returns the time remaining before the specified context's
+// deadline, and true, or zero and false when the context has no deadline.  When
+// gohm.New enforces a timeout, the request context given to the downstream
+// handler has a deadline, so handlers may use this to budget the time spent on
+// downstream calls.
+//
+//	func someHandler(w http.ResponseWriter, r *http.Request) {
+//		if remaining, ok := gohm.RemainingTime(r.Context()); ok && remaining < minimumBudget {
+//			gohm.Error(w, "insufficient time remaining", http.StatusServiceUnavailable)
+//			return
+//		}
+//		// ...
+//	}
+func RemainingTime(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// parseTimeout parses the value of a request timeout header, and returns the
+// duration and true, or zero and false when the value cannot be parsed or is
+// not positive.  The syntax is chosen by the header rather than by the value,
+// because values such as "2m" are valid in both syntaxes, yet mean different
+// durations.  When grpc is true, the value must be in grpc-timeout format.
+// Otherwise the following formats are tried in order:
+//
+//	duration : a Go duration, as parsed by time.ParseDuration, e.g., "1.5s"
+//	seconds  : a decimal number of seconds, e.g., "2" or "0.25"
+func parseTimeout(value string, grpc bool) (time.Duration, bool) {
+	if grpc {
+		return parseGRPCTimeout(value)
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, d > 0
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && f > 0 && f < float64(1<<63-1)/float64(time.Second) {
+		return time.Duration(f * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// parseGRPCTimeout parses a value in grpc-timeout format: up to 8 digits
+// followed by a unit: H, M, S, m, u, or n, e.g., "250m" for 250 milliseconds.
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	l := len(value)
+	if l < 2 || l > 9 {
+		return 0, false
+	}
+	var unit time.Duration
+	switch value[l-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	n, err := strconv.ParseUint(value[:l-1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Duration(n) * unit; d > 0 {
+		return d, true
+	}
+	return 0, false
+}
+
+// timeoutContext is the request context given to the downstream handler when
+// gohm enforces a timeout.  Like a context created by context.WithTimeout, it
+// is done with context.DeadlineExceeded when the timeout elapses, or with the
+// error of its parent when the parent is done first.  Unlike it, its timeout
+// may be stopped, which gohm does when the downstream handler hijacks the
+// connection, so the context of an upgraded connection lives as long as its
+// parent.
+type timeoutContext struct {
+	context.Context // parent
+
+	deadline   time.Time
+	done       chan struct{}
+	err        atomic.Value // error
+	once       sync.Once
+	stopParent func() bool
+	stopped    int32 // stopped is accessed atomically, and is set after the timeout is stopped
+	timer      *time.Timer
+}
+
+// newTimeoutContext returns a timeoutContext that is done after the specified
+// timeout, or when the specified parent context is done.
+func newTimeoutContext(parent context.Context, timeout time.Duration) *timeoutContext {
+	c := &timeoutContext{
+		Context:  parent,
+		deadline: time.Now().Add(timeout),
+		done:     make(chan struct{}),
+	}
+	c.timer = time.AfterFunc(timeout, func() { c.cancel(context.DeadlineExceeded) })
+	c.stopParent = context.AfterFunc(parent, func() { c.cancel(parent.Err()) })
+	return c
+}
+
+// cancel closes the Done channel, and records the error returned by Err, unless
+// the context is already done.
+func (c *timeoutContext) cancel(err error) {
+	c.once.Do(func() {
+		c.err.Store(err)
+		close(c.done)
+	})
+}
+
+// release stops the timeout, stops watching the parent context, and cancels the
+// context when it is not yet done.
+func (c *timeoutContext) release() {
+	c.timer.Stop()
+	c.stopParent()
+	c.cancel(context.Canceled)
+}
+
+// stopTimeout stops the timeout, so the context is done only when its parent
+// is done, and returns true, or returns false when the timeout has already
+// elapsed.
+func (c *timeoutContext) stopTimeout() bool {
+	if !c.timer.Stop() {
+		return false
+	}
+	atomic.StoreInt32(&c.stopped, 1)
+	return true
+}
+
+// restartTimeout restarts a timeout stopped by stopTimeout.
+func (c *timeoutContext) restartTimeout() {
+	atomic.StoreInt32(&c.stopped, 0)
+	c.timer.Reset(time.Until(c.deadline))
+}
+
+// Deadline returns the earlier of the deadline of the parent context and the
+// timeout, unless the timeout has been stopped.
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	deadline, ok := c.Context.Deadline()
+	if atomic.LoadInt32(&c.stopped) == 1 || (ok && deadline.Before(c.deadline)) {
+		return deadline, ok
+	}
+	return c.deadline, true
+}
+
+// Done returns a channel that is closed when the context is done.
+func (c *timeoutContext) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil until the context is done, then the reason it is done.
+func (c *timeoutContext) Err() error {
+	err, _ := c.err.Load().(error)
+	return err
+}
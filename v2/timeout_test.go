@@ -1,9 +1,13 @@
 package gohm_test
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -68,6 +72,430 @@ func TestTimeout(t *testing.T) {
 	})
 }
 
+func TestTimeoutHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+
+	var timeoutErr error
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}), gohm.Config{
+		Timeout: 5 * time.Millisecond,
+		TimeoutHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeoutErr = r.Context().Err()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte(`{"error":"timeout"}`))
+		}),
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	resp := recorder.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := timeoutErr, context.DeadlineExceeded; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := resp.StatusCode, http.StatusGatewayTimeout; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := string(body), `{"error":"timeout"}`; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestTimeoutHandlerPanics(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}), gohm.Config{
+		Timeout: 5 * time.Millisecond,
+		TimeoutHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}),
+	})
+
+	// The panic of the timeout handler is propagated to the caller, rather
+	// than causing a fatal error by unlocking an unlocked mutex.
+	recovered := func() (r interface{}) {
+		defer func() { r = recover() }()
+		handler.ServeHTTP(recorder, request)
+		return nil
+	}()
+
+	if got, want := recovered, "boom"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestTimeoutClientDisconnect(t *testing.T) {
+	var counters gohm.Counters
+	var timeoutHandlerInvoked bool
+	logOutput := new(bytes.Buffer)
+
+	release := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil).WithContext(ctx)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel() // simulate client disconnect
+		<-release
+	}), gohm.Config{
+		Counters:  &counters,
+		LogFormat: "{status} {error}",
+		LogWriter: logOutput,
+		Timeout:   time.Second,
+		TimeoutHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeoutHandlerInvoked = true
+		}),
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	// Wait for the abandoned handler to update the counters before copying
+	// them.
+	close(release)
+	for deadline := time.Now().Add(time.Second); counters.GetAbandonedReturned() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned handler not accounted after it returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if got, want := timeoutHandlerInvoked, false; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := logOutput.String(), "499 context canceled\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := counters.GetDisconnected(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.Get4xx(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.Get5xx(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetAndResetDisconnected(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetDisconnected(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestTimeoutClientDisconnectAfterCommit(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil).WithContext(ctx)
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		cancel() // simulate client disconnect
+		<-release
+	}), gohm.Config{
+		LogFormat: "{status} {error}",
+		LogWriter: logOutput,
+		Streaming: true,
+		Timeout:   time.Second,
+	})
+
+	handler.ServeHTTP(recorder, request)
+
+	// The status already sent to the client is logged.
+	if got, want := logOutput.String(), "200 context canceled\n"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		timeout time.Duration
+		want    string
+	}{
+		{name: "X-Request-Timeout", header: "", timeout: time.Second, want: "1.000000"},
+		{name: "X-Request-Timeout", header: "1.5s", timeout: 2 * time.Second, want: "1.500000"},
+		{name: "X-Request-Timeout", header: "0.125", timeout: time.Second, want: "0.125000"},
+		{name: "X-Request-Timeout", header: "2m", timeout: 3 * time.Minute, want: "120.000000"}, // minutes, not milliseconds
+		{name: "X-Request-Timeout", header: "250m", timeout: time.Second, want: "1.000000"},     // clamped
+		{name: "X-Request-Timeout", header: "bogus", timeout: time.Second, want: "1.000000"},
+		{name: "X-Request-Timeout", header: "-1s", timeout: time.Second, want: "1.000000"},
+		{name: "X-Request-Timeout", header: "3", timeout: 0, want: "-"}, // ignored without Timeout to bound it
+		{name: "X-Request-Timeout", header: "", timeout: 0, want: "-"},
+		{name: "grpc-timeout", header: "250m", timeout: time.Second, want: "0.250000"},
+		{name: "grpc-timeout", header: "2m", timeout: time.Second, want: "0.002000"},
+		{name: "grpc-timeout", header: "2S", timeout: time.Second, want: "1.000000"}, // clamped
+		{name: "grpc-timeout", header: "0m", timeout: time.Second, want: "1.000000"},
+		{name: "grpc-timeout", header: "1.5s", timeout: time.Second, want: "1.000000"}, // not grpc-timeout format
+		{name: "grpc-timeout", header: "99999999H", timeout: 0, want: "-"},
+		{name: "grpc-timeout", header: "99999999H", timeout: time.Second, want: "1.000000"},
+		{name: "Grpc-Timeout", header: "250m", timeout: time.Second, want: "0.250000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name+"/"+test.header+"/"+test.timeout.String(), func(t *testing.T) {
+			logOutput := new(bytes.Buffer)
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/some/url", nil)
+			if test.header != "" {
+				request.Header.Set(test.name, test.header)
+			}
+
+			var remaining time.Duration
+			var hasDeadline bool
+
+			handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remaining, hasDeadline = gohm.RemainingTime(r.Context())
+			}), gohm.Config{
+				LogFormat:     "{timeout}",
+				LogWriter:     logOutput,
+				Timeout:       test.timeout,
+				TimeoutHeader: test.name,
+			})
+
+			handler.ServeHTTP(recorder, request)
+
+			if got, want := logOutput.String(), test.want+"\n"; got != want {
+				t.Errorf("GOT: %q; WANT: %q", got, want)
+			}
+			if got, want := hasDeadline, test.want != "-"; got != want {
+				t.Errorf("GOT: %v; WANT: %v", got, want)
+			}
+			if hasDeadline {
+				want, _ := strconv.ParseFloat(test.want, 64)
+				if got := remaining.Seconds(); got <= 0 || got > want {
+					t.Errorf("GOT: %v; WANT: (0, %v]", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeoutAbandonedHandler(t *testing.T) {
+	var counters gohm.Counters
+	logOutput := new(syncBuffer)
+	release := make(chan struct{})
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // ignores context cancellation
+	}), gohm.Config{
+		Counters:     &counters,
+		LogAbandoned: true,
+		LogFormat:    "{status} {error}",
+		LogWriter:    logOutput,
+		Timeout:      5 * time.Millisecond,
+	})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+	handler.ServeHTTP(recorder, request)
+
+	if got, want := counters.GetAbandoned(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetAbandonedReturned(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for deadline := time.Now().Add(time.Second); counters.GetAbandonedReturned() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned handler not accounted after it returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if got, want := counters.GetAbandoned(), uint64(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetAbandonedOverrun(), 10*time.Millisecond; got < want {
+		t.Errorf("GOT: %v; WANT: >= %v", got, want)
+	}
+
+	// Log line is written after counters are updated.
+	for deadline := time.Now().Add(time.Second); strings.Count(logOutput.String(), "\n") < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned handler not logged: %q", logOutput.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	lines := strings.Split(logOutput.String(), "\n")
+	if got, want := lines[0], "503 context deadline exceeded"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := lines[1], "503 abandoned handler returned "; !strings.HasPrefix(got, want) {
+		t.Errorf("GOT: %q; WANT PREFIX: %q", got, want)
+	}
+
+	if got, want := counters.GetAndResetAbandonedReturned(), uint64(1); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := counters.GetAndResetAbandonedOverrun(), 10*time.Millisecond; got < want {
+		t.Errorf("GOT: %v; WANT: >= %v", got, want)
+	}
+	if got, want := counters.GetAbandonedOverrun(), time.Duration(0); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestTimeoutAbandonedHandlerHTTP2(t *testing.T) {
+	// The HTTP/2 server panics when the request's http.ResponseWriter is used
+	// after the handler returned, so every directive must be emitted from values
+	// copied before the abandoned handler is logged, which the handler's changes
+	// to the request must not affect.
+	logOutput := new(syncBuffer)
+	slogOutput := new(syncBuffer)
+	release := make(chan struct{})
+
+	server := httptest.NewUnstartedServer(gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // ignores context cancellation
+		r.Method = "PUT"
+	}), gohm.Config{
+		LogAbandoned: true,
+		LogFormat:    "{client-ip} {method} {uri} {proto} \"{request-line}\" {host} {path} {query} {user-agent} {request-bytes} {status} {resp-http-Content-Type} {error}",
+		LogWriter:    logOutput,
+		Logger:       slog.New(slog.NewTextHandler(slogOutput, nil)),
+		Timeout:      20 * time.Millisecond,
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	request, err := http.NewRequest("GET", server.URL+"/some/url?a=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("User-Agent", "test-agent/1.0")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if got, want := response.ProtoMajor, 2; got != want {
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+
+	close(release)
+
+	for deadline := time.Now().Add(time.Second); strings.Count(logOutput.String(), "\n") < 2 || strings.Count(slogOutput.String(), "\n") < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned handler not logged: %q; %q", logOutput.String(), slogOutput.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	want := "127.0.0.1 GET /some/url?a=1 HTTP/2.0 \"GET /some/url?a=1 HTTP/2.0\" " + host + " /some/url a=1 test-agent/1.0 0 503 text/plain; charset=utf-8 abandoned handler returned "
+	if got := strings.Split(logOutput.String(), "\n")[1]; !strings.HasPrefix(got, want) {
+		t.Errorf("GOT: %q; WANT PREFIX: %q", got, want)
+	}
+	if got, want := strings.Split(slogOutput.String(), "\n")[1], " method=GET "; !strings.Contains(got, want) {
+		t.Errorf("GOT: %q; WANT SUBSTRING: %q", got, want)
+	}
+}
+
+func TestTimeoutAbandonedHandlerPanics(t *testing.T) {
+	var counters gohm.Counters
+	release := make(chan struct{})
+
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // ignores context cancellation
+		panic("abandoned handler panic")
+	}), gohm.Config{
+		Counters: &counters,
+		Timeout:  5 * time.Millisecond,
+	})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/some/url", nil)
+	handler.ServeHTTP(recorder, request)
+
+	// The panic of the abandoned handler must not affect the response that was
+	// already sent.
+	close(release)
+
+	if got, want := recorder.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+
+	for deadline := time.Now().Add(time.Second); counters.GetAbandonedReturned() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned handler not accounted after it panicked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTimeoutAbandonedHandlerLogsResponseHeaderHTTP2(t *testing.T) {
+	// The HTTP/2 server panics when the http.ResponseWriter is used after the
+	// handler returned, which is when the abandoned handler is logged.
+	logOutput := new(syncBuffer)
+	release := make(chan struct{})
+
+	server := httptest.NewUnstartedServer(gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // ignores context cancellation
+	}), gohm.Config{
+		LogAbandoned: true,
+		LogFormat:    "{status} {resp-http-Content-Type} {error}",
+		LogWriter:    logOutput,
+		Timeout:      20 * time.Millisecond,
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if got, want := response.ProtoMajor, 2; got != want {
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+
+	close(release)
+
+	for deadline := time.Now().Add(time.Second); strings.Count(logOutput.String(), "\n") < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("abandoned handler not logged: %q", logOutput.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	lines := strings.Split(logOutput.String(), "\n")
+	if got, want := lines[0], "503 text/plain; charset=utf-8 context deadline exceeded"; got != want {
+		t.Errorf("GOT: %q; WANT: %q", got, want)
+	}
+	if got, want := lines[1], "503 text/plain; charset=utf-8 abandoned handler returned "; !strings.HasPrefix(got, want) {
+		t.Errorf("GOT: %q; WANT PREFIX: %q", got, want)
+	}
+}
+
 func BenchmarkWithTimeout(b *testing.B) {
 	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// don't bother exceeding timeout
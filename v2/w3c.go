@@ -0,0 +1,64 @@
+package gohm
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// W3CHeader returns the W3C Extended Log File Format directives, dated with
+// the specified time, that must precede the log lines emitted using
+// W3CExtendedLogFormat.  It may be used as RotatingFileWriterConfig.Header, so
+// the directives are written at the start of each log file.
+func W3CHeader(now time.Time) []byte {
+	return []byte("#Software: gohm\n#Version: 1.0\n#Date: " + now.UTC().Format("2006-01-02 15:04:05") + "\n#Fields: " + w3cFields + "\n")
+}
+
+// W3CWriter is an io.Writer that writes the W3C Extended Log File Format
+// directives to the io.Writer it wraps, before the first log line written to
+// it.  Handlers that share a log writer ought to share a W3CWriter, so the
+// directives are written once.
+//
+// W3CWriter cannot detect when the io.Writer it wraps starts a new file, so
+// to write the directives at the start of each file written by a
+// RotatingFileWriter, set RotatingFileWriterConfig.Header to W3CHeader instead.
+//
+//	logWriter := gohm.NewW3CWriter(os.Stdout)
+//	h := gohm.New(someHandler, gohm.Config{
+//		LogFormat: gohm.W3CExtendedLogFormat,
+//		LogWriter: logWriter,
+//	})
+type W3CWriter struct {
+	w           io.Writer
+	lock        sync.Mutex
+	wroteHeader bool
+}
+
+// NewW3CWriter returns a W3CWriter that writes to the specified io.Writer.
+func NewW3CWriter(w io.Writer) *W3CWriter {
+	return &W3CWriter{w: w}
+}
+
+// Write writes the specified log line to the wrapped io.Writer, preceded by
+// the W3C Extended Log File Format directives when they have not yet been
+// written.  The directives and the log line are written with a single call to
+// Write, so they are not separated by log lines written concurrently.
+func (ww *W3CWriter) Write(p []byte) (int, error) {
+	ww.lock.Lock()
+	defer ww.lock.Unlock()
+
+	if ww.wroteHeader {
+		return ww.w.Write(p)
+	}
+
+	header := W3CHeader(time.Now())
+	n, err := ww.w.Write(append(header, p...))
+	if err == nil {
+		ww.wroteHeader = true
+	}
+	// Report only the bytes of the log line that were written.
+	if n -= len(header); n < 0 {
+		n = 0
+	}
+	return n, err
+}
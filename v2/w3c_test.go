@@ -0,0 +1,141 @@
+package gohm_test
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karrick/gohm/v2"
+)
+
+func TestLogWithW3CExtendedLogFormat(t *testing.T) {
+	logOutput := new(bytes.Buffer)
+	var completed time.Time
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Complete the request in a later second than it began, so the date
+		// and time fields can only be the time the request completed.
+		time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+		w.Write([]byte("hello"))
+		completed = time.Now().UTC()
+	})
+	config := gohm.Config{LogFormat: gohm.W3CExtendedLogFormat, LogWriter: gohm.NewW3CWriter(logOutput)}
+
+	// Two handlers sharing a W3CWriter write the directives only once.
+	handler := gohm.New(next, config)
+	gohm.New(next, config).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), presetRequest())
+
+	// Parse the log as described by the W3C Extended Log File Format: lines
+	// starting with a number sign are directives, and the Fields directive
+	// names the space separated fields of each following line.
+	var fields []string
+	var entries []map[string]string
+	var version string
+	scanner := bufio.NewScanner(logOutput)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			if fields != nil {
+				t.Errorf("GOT: %q; WANT: directives only before first entry", line)
+			}
+			directive, value, _ := strings.Cut(line[1:], ": ")
+			switch directive {
+			case "Fields":
+				fields = strings.Fields(value)
+			case "Version":
+				version = value
+			}
+			continue
+		}
+		values := strings.Split(line, " ")
+		if got, want := len(values), len(fields); got != want {
+			t.Fatalf("GOT: %v; WANT: %v", got, want)
+		}
+		entry := make(map[string]string)
+		for i, field := range fields {
+			entry[field] = values[i]
+		}
+		entries = append(entries, entry)
+	}
+
+	if got, want := version, "1.0"; got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+	if got, want := len(entries), 2; got != want {
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+
+	want := map[string]string{
+		"c-ip":           "192.0.2.1",
+		"cs-username":    "alice",
+		"cs-method":      "GET",
+		"cs-uri-stem":    "/some/url",
+		"cs-uri-query":   "a=b",
+		"sc-status":      "200",
+		"sc-bytes":       "5",
+		"cs(User-Agent)": `Mozilla/5.0+(X11)+\"quoted\"\tagent`,
+		"cs(Referer)":    "https://example.com/",
+	}
+	for field, w := range want {
+		if got := entries[1][field]; got != w {
+			t.Errorf("%s: GOT: %v; WANT: %v", field, got, w)
+		}
+	}
+	for _, field := range []string{"cs-username", "cs-uri-query", "cs(User-Agent)", "cs(Referer)"} {
+		if got, want := entries[0][field], "-"; got != want {
+			t.Errorf("%s: GOT: %v; WANT: %v", field, got, want)
+		}
+	}
+	if _, err := strconv.ParseFloat(entries[1]["time-taken"], 64); err != nil {
+		t.Errorf("GOT: %v; WANT: %v", err, nil)
+	}
+	if got, want := entries[1]["date"]+" "+entries[1]["time"], completed.Format("2006-01-02 15:04:05"); got != want {
+		t.Errorf("GOT: %v; WANT: %v", got, want)
+	}
+}
+
+func TestW3CHeaderWithRotatingFileWriter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	rfw, err := gohm.NewRotatingFileWriter(path, gohm.RotatingFileWriterConfig{Header: gohm.W3CHeader})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := gohm.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), gohm.Config{LogFormat: gohm.W3CExtendedLogFormat, LogWriter: rfw})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err := rfw.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err := rfw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the rotated and the new log file start with the directives, and
+	// have one log line.
+	for _, name := range append(rotatedFiles(t, dir), "access.log") {
+		lines := strings.Split(strings.TrimSuffix(readFile(t, filepath.Join(dir, name)), "\n"), "\n")
+		if got, want := len(lines), 5; got != want {
+			t.Fatalf("%s: GOT: %v; WANT: %v", name, got, want)
+		}
+		if got, want := lines[0], "#Software: gohm"; got != want {
+			t.Errorf("%s: GOT: %v; WANT: %v", name, got, want)
+		}
+		if got, want := lines[3], "#Fields: date time c-ip"; !strings.HasPrefix(got, want) {
+			t.Errorf("%s: GOT: %v; WANT: prefix %v", name, got, want)
+		}
+		if strings.HasPrefix(lines[4], "#") {
+			t.Errorf("%s: GOT: %v; WANT: log line", name, lines[4])
+		}
+	}
+}